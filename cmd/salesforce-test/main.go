@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"log"
 	"sort"
-	"strconv"
 
 	"github.com/canonical/athena-core/pkg/common"
 	"github.com/canonical/athena-core/pkg/config"
@@ -109,6 +108,14 @@ func main() {
 	}
 }
 
+func buildQuery(query *common.SOQLQuery) string {
+	result, err := query.Build()
+	if err != nil {
+		log.Fatalf("Failed to build query: %v", err)
+	}
+	return result
+}
+
 func getQueryResult(sfClient common.SalesforceClient, queryString string) {
 	log.Printf("Running query: '%s'", queryString)
 	records, err := sfClient.Query(queryString)
@@ -161,7 +168,7 @@ func newCaseFeed(sfClient common.SalesforceClient, caseId string, comment string
 
 func getFeedItems(caseId string, sfClient common.SalesforceClient) {
 	log.Print("Getting all FeedItem objects for case")
-	query := fmt.Sprintf("SELECT Id, Body FROM FeedItem WHERE ParentID = '%s'", caseId)
+	query := buildQuery(common.NewSOQLQuery("FeedItem", "Id", "Body").Where("ParentId", "=", caseId))
 	log.Printf("Running query: '%s'", query)
 	records, err := sfClient.Query(query)
 	if err != nil {
@@ -177,7 +184,7 @@ func getFeedItems(caseId string, sfClient common.SalesforceClient) {
 
 func getCaseFeeds(caseId string, sfClient common.SalesforceClient) {
 	log.Print("Getting all CaseFeed objects for case")
-	query := fmt.Sprintf("SELECT Id, Body FROM CaseFeed WHERE ParentID = '%s'", caseId)
+	query := buildQuery(common.NewSOQLQuery("CaseFeed", "Id", "Body").Where("ParentId", "=", caseId))
 	log.Printf("Running query: '%s'", query)
 	records, err := sfClient.Query(query)
 	if err != nil {
@@ -195,7 +202,7 @@ func getCaseFeeds(caseId string, sfClient common.SalesforceClient) {
 
 func getCaseComments(caseId string, sfClient common.SalesforceClient) {
 	log.Print("Getting case comments")
-	query := fmt.Sprintf("SELECT Id, CommentBody FROM CaseComment WHERE ParentId = '%s'", caseId)
+	query := buildQuery(common.NewSOQLQuery("CaseComment", "Id", "CommentBody").Where("ParentId", "=", caseId))
 	records, err := sfClient.Query(query)
 	if err != nil {
 		log.Fatalf("Failed to get case comments: %v", err)
@@ -209,14 +216,13 @@ func getCaseComments(caseId string, sfClient common.SalesforceClient) {
 }
 
 func getCase(sfClient common.SalesforceClient) string {
-	caseNumberAsInt, err := strconv.ParseInt(*caseNumber, 10, 64)
+	caseNumberFormatted, err := common.NormalizeCaseNumber(*caseNumber)
 	if err != nil {
-		log.Fatalf("Failed to parse the case number %s", *caseNumber)
+		log.Fatalf("Failed to parse the case number %s: %s", *caseNumber, err)
 	}
-	caseNumberFormatted := fmt.Sprintf("%08d", caseNumberAsInt)
 
 	log.Printf("Searching for case %s", caseNumberFormatted)
-	query := fmt.Sprintf("SELECT Id, CaseNumber FROM Case WHERE CaseNumber = '%s'", caseNumberFormatted)
+	query := buildQuery(common.NewSOQLQuery("Case", "Id", "CaseNumber").Where("CaseNumber", "=", caseNumberFormatted))
 	records, err := sfClient.Query(query)
 	if err != nil {
 		log.Fatalf("Failed to query Salesforce: %v", err)
@@ -0,0 +1,172 @@
+package common
+
+import (
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/canonical/athena-core/pkg/common/db"
+	"github.com/canonical/athena-core/pkg/config"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+type cachedCase struct {
+	sfCase  *Case
+	fetched time.Time
+}
+
+// CaseCache caches cases looked up in Salesforce in memory and, if a
+// database connection is given, in the database so that the cache is shared
+// between the monitor and the processor(s).
+type CaseCache struct {
+	Db  *gorm.DB
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedCase
+}
+
+func NewCaseCache(dbConn *gorm.DB, ttl time.Duration) *CaseCache {
+	return &CaseCache{
+		Db:      dbConn,
+		TTL:     ttl,
+		entries: make(map[string]cachedCase),
+	}
+}
+
+// NewCaseCacheFromConfig creates a cache with the TTL configured in
+// salesforce.case-cache-ttl.
+func NewCaseCacheFromConfig(cfg *config.Config, dbConn *gorm.DB) (*CaseCache, error) {
+	var ttl time.Duration
+	if cfg.Salesforce.CaseCacheTTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(cfg.Salesforce.CaseCacheTTL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewCaseCache(dbConn, ttl), nil
+}
+
+// Get returns the cached case for the case number, if it has not expired.
+func (c *CaseCache) Get(number string) (*Case, bool) {
+	if c.TTL <= 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[number]; ok {
+		if time.Since(entry.fetched) < c.TTL {
+			return entry.sfCase, true
+		}
+		delete(c.entries, number)
+	}
+
+	if c.Db == nil {
+		return nil, false
+	}
+
+	var row db.Case
+	if err := c.Db.Where("case_number = ? AND fetched > ?", number, time.Now().Add(-c.TTL)).First(&row).Error; err != nil {
+		return nil, false
+	}
+	sfCase := &Case{
+		Id:         row.CaseID,
+		CaseNumber: row.CaseNumber,
+		AccountId:  row.AccountID,
+		Customer:   row.Customer,
+	}
+	if row.Fields != "" {
+		if err := json.Unmarshal([]byte(row.Fields), &sfCase.Fields); err != nil {
+			log.Warnf("Ignoring invalid cached fields of case %s: %s", number, err)
+		}
+	}
+	c.entries[number] = cachedCase{sfCase: sfCase, fetched: row.Fetched}
+	return sfCase, true
+}
+
+// Put adds the case to the cache under the given case number.
+func (c *CaseCache) Put(number string, sfCase *Case) {
+	if c.TTL <= 0 || sfCase == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.entries[number] = cachedCase{sfCase: sfCase, fetched: now}
+
+	if c.Db == nil {
+		return
+	}
+
+	fields, err := json.Marshal(sfCase.Fields)
+	if err != nil {
+		log.Warnf("Failed to encode fields of case %s: %s", number, err)
+		return
+	}
+	var row db.Case
+	if err := c.Db.Where(db.Case{CaseNumber: number}).FirstOrInit(&row).Error; err != nil {
+		log.Debugf("Failed to look up cached case %s: %s", number, err)
+		return
+	}
+	row.CaseID = sfCase.Id
+	row.AccountID = sfCase.AccountId
+	row.Customer = sfCase.Customer
+	row.Fields = string(fields)
+	row.Fetched = now
+	if err := c.Db.Save(&row).Error; err != nil {
+		log.Debugf("Failed to cache case %s: %s", number, err)
+	}
+}
+
+// GetCase returns the case for the case number, from the cache if possible.
+func (c *CaseCache) GetCase(client SalesforceClient, number string) (*Case, error) {
+	if sfCase, ok := c.Get(number); ok {
+		return sfCase, nil
+	}
+	sfCase, err := client.GetCaseByNumber(number)
+	if err != nil {
+		return nil, err
+	}
+	c.Put(number, sfCase)
+	return sfCase, nil
+}
+
+// GetCases returns the cases for the case numbers. Case numbers which are not
+// cached are looked up with a single bulk query. Case numbers which were not
+// found are missing from the returned map.
+func (c *CaseCache) GetCases(client SalesforceClient, numbers []string) (map[string]*Case, error) {
+	var results = make(map[string]*Case)
+	var missing []string
+	for _, number := range numbers {
+		if _, ok := results[number]; ok {
+			continue
+		}
+		if sfCase, ok := c.Get(number); ok {
+			results[number] = sfCase
+		} else if !slices.Contains(missing, number) {
+			missing = append(missing, number)
+		}
+	}
+
+	if len(missing) == 0 {
+		return results, nil
+	}
+
+	log.Debugf("Looking up %d case(s) in Salesforce", len(missing))
+	found, err := client.GetCasesByNumbers(missing)
+	if err != nil {
+		return results, err
+	}
+	for number, sfCase := range found {
+		c.Put(number, sfCase)
+		results[number] = sfCase
+	}
+	return results, nil
+}
@@ -0,0 +1,95 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/canonical/athena-core/pkg/common/db"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+type CountingSalesforceClient struct {
+	BaseSalesforceClient
+	single, bulk int
+}
+
+func (sf *CountingSalesforceClient) GetCaseByNumber(number string) (*Case, error) {
+	sf.single++
+	if number == validCaseNumber {
+		return &Case{Id: "id-" + number, CaseNumber: number, Customer: "ACME"}, nil
+	}
+	return nil, ErrNoCaseFound{number}
+}
+
+func (sf *CountingSalesforceClient) GetCasesByNumbers(numbers []string) (map[string]*Case, error) {
+	sf.bulk++
+	results := make(map[string]*Case)
+	for _, number := range numbers {
+		if number == validCaseNumber {
+			results[number] = &Case{Id: "id-" + number, CaseNumber: number, Customer: "ACME", Fields: map[string]string{"Status": "New"}}
+		}
+	}
+	return results, nil
+}
+
+func TestCaseCacheGetCase(t *testing.T) {
+	client := &CountingSalesforceClient{}
+	cache := NewCaseCache(nil, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		sfCase, err := cache.GetCase(client, validCaseNumber)
+		assert.Nil(t, err)
+		assert.Equal(t, "ACME", sfCase.Customer)
+	}
+	assert.Equal(t, 1, client.single)
+
+	_, err := cache.GetCase(client, invalidCaseNumber)
+	assert.NotNil(t, err)
+}
+
+func TestCaseCacheGetCases(t *testing.T) {
+	client := &CountingSalesforceClient{}
+	cache := NewCaseCache(nil, time.Minute)
+
+	cases, err := cache.GetCases(client, []string{validCaseNumber, invalidCaseNumber, validCaseNumber})
+	assert.Nil(t, err)
+	assert.Len(t, cases, 1)
+	assert.Equal(t, 1, client.bulk)
+
+	cases, err = cache.GetCases(client, []string{validCaseNumber})
+	assert.Nil(t, err)
+	assert.Len(t, cases, 1)
+	assert.Equal(t, 1, client.bulk)
+}
+
+func TestCaseCacheDisabled(t *testing.T) {
+	client := &CountingSalesforceClient{}
+	cache := NewCaseCache(nil, 0)
+
+	_, _ = cache.GetCase(client, validCaseNumber)
+	_, _ = cache.GetCase(client, validCaseNumber)
+	assert.Equal(t, 2, client.single)
+}
+
+func TestCaseCacheDatabase(t *testing.T) {
+	dbConn, err := gorm.Open(sqlite.Open("file::memory:"))
+	assert.Nil(t, err)
+	assert.Nil(t, dbConn.AutoMigrate(db.Case{}))
+
+	client := &CountingSalesforceClient{}
+	_, err = NewCaseCache(dbConn, time.Minute).GetCases(client, []string{validCaseNumber})
+	assert.Nil(t, err)
+
+	// A second cache, e.g. in the processor, finds the case in the database.
+	sfCase, ok := NewCaseCache(dbConn, time.Minute).Get(validCaseNumber)
+	assert.True(t, ok)
+	assert.Equal(t, "id-"+validCaseNumber, sfCase.Id)
+	assert.Equal(t, "ACME", sfCase.Customer)
+	assert.Equal(t, "New", sfCase.Fields["Status"])
+	assert.Equal(t, 1, client.bulk)
+
+	_, ok = NewCaseCache(dbConn, time.Nanosecond).Get(validCaseNumber)
+	assert.False(t, ok)
+}
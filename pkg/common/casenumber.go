@@ -0,0 +1,208 @@
+package common
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/canonical/athena-core/pkg/config"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultCaseNumberStrategy is the name of the strategy used if no strategies
+// are configured, see GetCaseNumberFromFilename.
+const DefaultCaseNumberStrategy = "default"
+
+const (
+	defaultDirectoryPattern = `^(?P<case>\d{6,8})$`
+	defaultSidecarSuffix    = ".athena.yaml"
+	defaultSidecarKey       = "case-number"
+)
+
+// SidecarReader returns the contents of the file at the given path.
+type SidecarReader func(path string) ([]byte, error)
+
+type caseNumberStrategy interface {
+	Name() string
+	Extract(filePath string) (string, error)
+}
+
+type defaultStrategy struct{}
+
+func (s *defaultStrategy) Name() string {
+	return DefaultCaseNumberStrategy
+}
+
+func (s *defaultStrategy) Extract(filePath string) (string, error) {
+	return GetCaseNumberFromFilename(filePath)
+}
+
+// matchCaseNumber returns the "case" named group of the first match of the
+// regex, the first group if there is no such group, or the whole match.
+func matchCaseNumber(regex *regexp.Regexp, value string) (string, bool) {
+	match := regex.FindStringSubmatch(value)
+	if match == nil {
+		return "", false
+	}
+	if index := regex.SubexpIndex("case"); index > 0 {
+		return match[index], match[index] != ""
+	}
+	if len(match) > 1 {
+		return match[1], match[1] != ""
+	}
+	return match[0], match[0] != ""
+}
+
+type regexStrategy struct {
+	regexes []*regexp.Regexp
+}
+
+func (s *regexStrategy) Name() string {
+	return "regex"
+}
+
+func (s *regexStrategy) Extract(filePath string) (string, error) {
+	for _, regex := range s.regexes {
+		if number, ok := matchCaseNumber(regex, path.Base(filePath)); ok {
+			return number, nil
+		}
+	}
+	return "", fmt.Errorf("no pattern matched filename '%s'", path.Base(filePath))
+}
+
+type directoryStrategy struct {
+	regexes []*regexp.Regexp
+}
+
+func (s *directoryStrategy) Name() string {
+	return "directory"
+}
+
+func (s *directoryStrategy) Extract(filePath string) (string, error) {
+	for _, directory := range strings.Split(path.Dir(filePath), "/") {
+		for _, regex := range s.regexes {
+			if number, ok := matchCaseNumber(regex, directory); ok {
+				return number, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no pattern matched a directory of '%s'", filePath)
+}
+
+type sidecarStrategy struct {
+	suffix, key string
+	reader      SidecarReader
+}
+
+func (s *sidecarStrategy) Name() string {
+	return "sidecar"
+}
+
+func (s *sidecarStrategy) Extract(filePath string) (string, error) {
+	if s.reader == nil {
+		return "", fmt.Errorf("sidecar files can not be read here")
+	}
+	data, err := s.reader(filePath + s.suffix)
+	if err != nil {
+		return "", err
+	}
+	var metadata map[string]interface{}
+	if err := yaml.Unmarshal(data, &metadata); err != nil {
+		return "", fmt.Errorf("failed to parse sidecar file '%s': %s", filePath+s.suffix, err)
+	}
+	value, ok := metadata[s.key]
+	if !ok {
+		return "", fmt.Errorf("sidecar file '%s' has no key '%s'", filePath+s.suffix, s.key)
+	}
+	return fmt.Sprintf("%v", value), nil
+}
+
+// CaseNumberExtractor extracts case numbers from file paths by trying the
+// configured strategies in order.
+type CaseNumberExtractor struct {
+	strategies []caseNumberStrategy
+}
+
+func compilePatterns(patterns []string, defaultPattern string) ([]*regexp.Regexp, error) {
+	if len(patterns) == 0 {
+		if defaultPattern == "" {
+			return nil, fmt.Errorf("no patterns given")
+		}
+		patterns = []string{defaultPattern}
+	}
+	var regexes []*regexp.Regexp
+	for _, pattern := range patterns {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %s", pattern, err)
+		}
+		regexes = append(regexes, regex)
+	}
+	return regexes, nil
+}
+
+// NewCaseNumberExtractor creates an extractor from the configuration. The
+// reader is used by the sidecar strategy and may be nil, in which case that
+// strategy never finds a case number.
+func NewCaseNumberExtractor(cfg *config.CaseNumber, reader SidecarReader) (*CaseNumberExtractor, error) {
+	var extractor CaseNumberExtractor
+	for i, strategy := range cfg.Strategies {
+		switch strategy.Type {
+		case "regex":
+			regexes, err := compilePatterns(strategy.Patterns, "")
+			if err != nil {
+				return nil, fmt.Errorf("case-number strategy %d: %s", i, err)
+			}
+			extractor.strategies = append(extractor.strategies, &regexStrategy{regexes: regexes})
+		case "directory":
+			regexes, err := compilePatterns(strategy.Patterns, defaultDirectoryPattern)
+			if err != nil {
+				return nil, fmt.Errorf("case-number strategy %d: %s", i, err)
+			}
+			extractor.strategies = append(extractor.strategies, &directoryStrategy{regexes: regexes})
+		case "sidecar":
+			suffix := strategy.Suffix
+			if suffix == "" {
+				suffix = defaultSidecarSuffix
+			}
+			key := strategy.Key
+			if key == "" {
+				key = defaultSidecarKey
+			}
+			extractor.strategies = append(extractor.strategies, &sidecarStrategy{suffix: suffix, key: key, reader: reader})
+		case DefaultCaseNumberStrategy:
+			extractor.strategies = append(extractor.strategies, &defaultStrategy{})
+		default:
+			return nil, fmt.Errorf("case-number strategy %d: unknown type '%s'", i, strategy.Type)
+		}
+	}
+	if len(extractor.strategies) == 0 {
+		extractor.strategies = append(extractor.strategies, &defaultStrategy{})
+	}
+	return &extractor, nil
+}
+
+// IsSidecar returns whether the file is a sidecar file of a sidecar strategy.
+func (e *CaseNumberExtractor) IsSidecar(filePath string) bool {
+	for _, strategy := range e.strategies {
+		if sidecar, ok := strategy.(*sidecarStrategy); ok && strings.HasSuffix(filePath, sidecar.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Extract returns the case number of the file and the name of the strategy
+// which found it.
+func (e *CaseNumberExtractor) Extract(filePath string) (string, string, error) {
+	var failures []string
+	for _, strategy := range e.strategies {
+		number, err := strategy.Extract(filePath)
+		if err == nil {
+			return number, strategy.Name(), nil
+		}
+		failures = append(failures, fmt.Sprintf("%s: %s", strategy.Name(), err))
+	}
+	return "", "", fmt.Errorf("failed to identify case number of '%s' (%s)", filePath, strings.Join(failures, "; "))
+}
@@ -0,0 +1,71 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/canonical/athena-core/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaseNumberExtractorDefault(t *testing.T) {
+	extractor, err := NewCaseNumberExtractor(&config.CaseNumber{}, nil)
+	assert.Nil(t, err)
+
+	number, strategy, err := extractor.Extract("/uploads/sosreport-123456.tar.xz")
+	assert.Nil(t, err)
+	assert.Equal(t, "123456", number)
+	assert.Equal(t, DefaultCaseNumberStrategy, strategy)
+
+	_, _, err = extractor.Extract("/uploads/sosreport-abc.tar.xz")
+	assert.NotNil(t, err)
+}
+
+func TestCaseNumberExtractorStrategies(t *testing.T) {
+	sidecars := map[string]string{
+		"/uploads/sosreport-host.tar.xz.athena.yaml": "case-number: 7654321\n",
+	}
+	reader := func(path string) ([]byte, error) {
+		if data, ok := sidecars[path]; ok {
+			return []byte(data), nil
+		}
+		return nil, fmt.Errorf("file '%s' not found", path)
+	}
+
+	extractor, err := NewCaseNumberExtractor(&config.CaseNumber{Strategies: []config.CaseNumberStrategy{
+		{Type: "regex", Patterns: []string{`case-(?P<case>\d+)`, `^(\d{8})_`}},
+		{Type: "directory"},
+		{Type: "sidecar"},
+	}}, reader)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		path, number, strategy string
+	}{
+		{"/uploads/sosreport-case-42.tar.xz", "42", "regex"},
+		{"/uploads/01234567_sosreport.tar.xz", "01234567", "regex"},
+		{"/uploads/123456/sosreport-host.tar.xz", "123456", "directory"},
+		{"/uploads/sosreport-host.tar.xz", "7654321", "sidecar"},
+	}
+	for _, test := range tests {
+		number, strategy, err := extractor.Extract(test.path)
+		assert.Nil(t, err, test.path)
+		assert.Equal(t, test.number, number, test.path)
+		assert.Equal(t, test.strategy, strategy, test.path)
+	}
+
+	_, _, err = extractor.Extract("/uploads/other.tar.xz")
+	assert.NotNil(t, err)
+}
+
+func TestCaseNumberExtractorInvalid(t *testing.T) {
+	for _, strategy := range []config.CaseNumberStrategy{
+		{Type: "unknown"},
+		{Type: "regex"},
+		{Type: "regex", Patterns: []string{"("}},
+		{Type: "directory", Patterns: []string{"("}},
+	} {
+		_, err := NewCaseNumberExtractor(&config.CaseNumber{Strategies: []config.CaseNumberStrategy{strategy}}, nil)
+		assert.NotNil(t, err, strategy.Type)
+	}
+}
@@ -0,0 +1,17 @@
+package db
+
+import (
+	"gorm.io/gorm"
+)
+
+// ActionRun records a subscriber action which was run for a batch of reports
+// so that it is not run again when the batch is retried.
+type ActionRun struct {
+	gorm.Model
+
+	DedupKey   string `gorm:"uniqueIndex;size:64"`
+	CaseID     string
+	Subscriber string
+	Type       string
+	Result     string // E.g. the ID of a created task
+}
@@ -0,0 +1,16 @@
+package db
+
+import (
+	"gorm.io/gorm"
+)
+
+// Artifact is a file written by a script which was uploaded next to its
+// output.
+type Artifact struct {
+	gorm.Model
+
+	Name           string // Path relative to the working directory of the script
+	Size           int64
+	UploadLocation string
+	ScriptID       uint
+}
@@ -0,0 +1,19 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Case caches the Salesforce case a case number resolves to.
+type Case struct {
+	gorm.Model
+
+	CaseNumber string `gorm:"uniqueIndex;size:64"`
+	CaseID     string
+	AccountID  string
+	Customer   string
+	Fields     string `gorm:"type:text"` // JSON encoded additional case fields
+	Fetched    time.Time
+}
@@ -0,0 +1,21 @@
+package db
+
+import (
+	"gorm.io/gorm"
+)
+
+// Comment is a comment, or one chunk of a split comment, posted on a case in
+// Salesforce.
+type Comment struct {
+	gorm.Model
+
+	DedupKey     string `gorm:"uniqueIndex;size:64"` // Identifies the chunk across retries of a batch
+	BatchKey     string `gorm:"index;size:64"`       // Identifies the comment all chunks belong to
+	CaseID       string
+	Subscriber   string
+	Chunk        int // Index of the chunk starting at 1
+	Chunks       int
+	SalesforceID string
+	Chatter      bool     // Posted as FeedItem instead of CaseComment
+	Reports      []Report `gorm:"many2many:comment_reports"`
+}
@@ -28,7 +28,7 @@ func GetDBConn(cfg *config.Config) (*gorm.DB, error) {
 	switch cfg.Db.Dialect {
 	case "sqlite":
 		log.Debugln("Will not change collation")
-		dbInstance.AutoMigrate(File{}, Report{}, Script{})
+		dbInstance.AutoMigrate(File{}, Report{}, Script{}, Artifact{}, Case{}, Comment{}, ActionRun{})
 	case "mysql":
 		var lockName = "migrate_lock"
 		var timeout = 10 // seconds
@@ -37,11 +37,18 @@ func GetDBConn(cfg *config.Config) (*gorm.DB, error) {
 		if lock == 1 {
 			if !dbInstance.Migrator().HasColumn(&File{}, "Path") {
 				log.Debugln("Changing collation to UTF-8")
-				dbInstance.AutoMigrate(File{}, Report{}, Script{})
+				dbInstance.AutoMigrate(File{}, Report{}, Script{}, Artifact{}, Case{}, Comment{}, ActionRun{})
 				err = dbInstance.Exec("ALTER TABLE files MODIFY Path VARCHAR(10240) CHARACTER SET utf8 COLLATE utf8_general_ci").Error
 				if err != nil {
 					log.Errorln("Could not change collation of files table")
 				}
+			} else if cfg.Db.AutoMigrate {
+				// Add columns and tables introduced since the
+				// database was created.
+				log.Infoln("Migrating database schema")
+				dbInstance.AutoMigrate(File{}, Report{}, Script{}, Artifact{}, Case{}, Comment{}, ActionRun{})
+			} else {
+				log.Infoln("Not migrating existing database, set db.auto-migrate to add new tables and columns")
 			}
 			dbInstance.Exec("DO RELEASE_LOCK(?)", lockName)
 		} else {
@@ -9,10 +9,15 @@ import (
 type File struct {
 	gorm.Model
 
-	Created    time.Time `gorm:"autoCreateTime"` // Use unix seconds as creating time
-	Dispatched bool      `gorm:"default:false"`
-	Path       string    `gorm:"primary_key,size:10240"`
-	Reports    []Report
+	Created            time.Time `gorm:"autoCreateTime"` // Use unix seconds as creating time
+	Dispatched         bool      `gorm:"default:false"`
+	Path               string    `gorm:"primary_key,size:10240"`
+	Size               int64
+	Checksum           string
+	SkipReason         string // Why the file was not dispatched, if it was excluded
+	CaseNumber         string
+	CaseNumberStrategy string // How the case number was extracted
+	Reports            []Report
 }
 
 type Report struct {
@@ -20,20 +25,35 @@ type Report struct {
 
 	Created    time.Time `gorm:"<-:create"`
 	Commented  bool      `gorm:"default:false"`
+	Skipped    bool      `gorm:"default:false"`
+	SkipReason string    // Why no comment was posted for the report
 	Subscriber string
 	Name       string
 	FileName   string
 	FileID     uint
 	FilePath   string
 	CaseID     string
+	CaseNumber string
+	Customer   string
+	FileSize   int64
+	Uploaded   time.Time // When the monitor found the file on files.com
 	Scripts    []Script
 }
 
 type Script struct {
 	gorm.Model
 
-	Output         string `gorm:"type:longtext"`
-	Name           string
-	UploadLocation string
-	ReportID       uint
+	Output               string `gorm:"type:longtext"` // Standard output
+	Stderr               string `gorm:"type:longtext"`
+	Name                 string
+	UploadLocation       string
+	UploadURL            string // files.com URL of UploadLocation
+	StderrUploadLocation string // Set if the standard error was uploaded
+	ExitCode             int
+	OutputFormat         string      // text, json or yaml
+	Data                 interface{} `gorm:"-"` // Parsed json or yaml output, set when rendering comments
+	ContentVersionID     string      // Set if the output was attached to the case
+	ContentDocumentID    string
+	Artifacts            []Artifact
+	ReportID             uint
 }
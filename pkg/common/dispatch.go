@@ -0,0 +1,105 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/canonical/athena-core/pkg/common/db"
+)
+
+// DispatchMessageVersion is the version of the message format the monitor
+// publishes for every file it dispatches to a processor.
+const DispatchMessageVersion = 1
+
+// DispatchMessage is the message sent from the monitor to the processor(s)
+// for every new file found. It is decoupled from the database schema so that
+// the monitor and the processor can be upgraded independently.
+type DispatchMessage struct {
+	Version       int       `json:"version"`
+	FileID        uint      `json:"file-id,omitempty"` // ID of the file in the database of the monitor
+	Path          string    `json:"path"`
+	Size          int64     `json:"size,omitempty"`
+	Checksum      string    `json:"checksum,omitempty"`
+	Created       time.Time `json:"created"`
+	CaseNumber    string    `json:"case-number,omitempty"`
+	Customer      string    `json:"customer,omitempty"`
+	Rule          string    `json:"rule,omitempty"`
+	Reports       []string  `json:"reports,omitempty"` // Reports to run, all if empty
+	Monitor       string    `json:"monitor,omitempty"`
+	CorrelationID string    `json:"correlation-id,omitempty"` // Logged by the monitor and the processor
+}
+
+// NewDispatchMessage creates a new message for the given file with a fresh
+// correlation ID.
+func NewDispatchMessage(file *db.File) *DispatchMessage {
+	return &DispatchMessage{
+		Version:       DispatchMessageVersion,
+		FileID:        file.ID,
+		Path:          file.Path,
+		Size:          file.Size,
+		Checksum:      file.Checksum,
+		Created:       file.Created,
+		CorrelationID: NewCorrelationID(),
+	}
+}
+
+// NewCorrelationID returns a random identifier used to correlate log messages
+// of the monitor and the processor for a single dispatched file.
+func NewCorrelationID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
+
+// File returns the database representation of the dispatched file.
+func (m *DispatchMessage) File() *db.File {
+	file := &db.File{
+		Created:  m.Created,
+		Path:     m.Path,
+		Size:     m.Size,
+		Checksum: m.Checksum,
+	}
+	file.ID = m.FileID
+	return file
+}
+
+type dispatchMessage DispatchMessage
+
+// UnmarshalJSON decodes a dispatch message. Messages without a version are
+// assumed to have been published by an older monitor which sent the raw
+// db.File structure.
+func (m *DispatchMessage) UnmarshalJSON(data []byte) error {
+	var probe struct {
+		Version *int   `json:"version"`
+		TraceID string `json:"trace-id"` // Name of the correlation ID of older monitors
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return err
+	}
+
+	if probe.Version == nil {
+		var file db.File
+		if err := json.Unmarshal(data, &file); err != nil {
+			return err
+		}
+		*m = DispatchMessage{FileID: file.ID, Path: file.Path, Size: file.Size, Checksum: file.Checksum, Created: file.Created}
+		return nil
+	}
+
+	if *probe.Version > DispatchMessageVersion {
+		return fmt.Errorf("unsupported dispatch message version %d", *probe.Version)
+	}
+
+	if err := json.Unmarshal(data, (*dispatchMessage)(m)); err != nil {
+		return err
+	}
+	if m.CorrelationID == "" {
+		m.CorrelationID = probe.TraceID
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package common
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/canonical/athena-core/pkg/common/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatchMessageRoundTrip(t *testing.T) {
+	file := &db.File{Path: "/uploads/sosreport-123456.tar.xz", Size: 42, Checksum: "md5:abc"}
+	file.ID = 7
+	message := NewDispatchMessage(file)
+	message.CaseNumber = "123456"
+	message.Customer = "ACME"
+	message.Rule = "filename:.* -> sosreports"
+	message.Monitor = "monitor-0"
+
+	data, err := json.Marshal(message)
+	assert.Nil(t, err)
+
+	var decoded DispatchMessage
+	assert.Nil(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, DispatchMessageVersion, decoded.Version)
+	assert.Equal(t, uint(7), decoded.File().ID)
+	assert.Equal(t, message.Path, decoded.Path)
+	assert.Equal(t, int64(42), decoded.Size)
+	assert.Equal(t, "md5:abc", decoded.Checksum)
+	assert.Equal(t, "123456", decoded.CaseNumber)
+	assert.Equal(t, "ACME", decoded.Customer)
+	assert.Equal(t, message.Rule, decoded.Rule)
+	assert.Equal(t, "monitor-0", decoded.Monitor)
+	assert.NotEmpty(t, decoded.CorrelationID)
+	assert.Equal(t, message.CorrelationID, decoded.CorrelationID)
+
+	// Older monitors called the correlation ID trace ID.
+	var legacy DispatchMessage
+	assert.Nil(t, json.Unmarshal([]byte(`{"version": 1, "path": "/uploads/file", "trace-id": "abc"}`), &legacy))
+	assert.Equal(t, "abc", legacy.CorrelationID)
+}
+
+func TestDispatchMessageLegacyFile(t *testing.T) {
+	file := db.File{Path: "/uploads/sosreport-123456.tar.xz", Dispatched: true}
+	file.ID = 7
+	data, err := json.Marshal(file)
+	assert.Nil(t, err)
+
+	var decoded DispatchMessage
+	assert.Nil(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, 0, decoded.Version)
+	assert.Equal(t, "/uploads/sosreport-123456.tar.xz", decoded.Path)
+	assert.Equal(t, "/uploads/sosreport-123456.tar.xz", decoded.File().Path)
+	assert.Equal(t, uint(7), decoded.File().ID)
+}
+
+func TestDispatchMessageUnsupportedVersion(t *testing.T) {
+	var decoded DispatchMessage
+	err := json.Unmarshal([]byte(`{"version": 99, "path": "/uploads/file"}`), &decoded)
+	assert.NotNil(t, err)
+}
@@ -76,13 +76,25 @@ func (client *BaseFilesComClient) GetFiles(dirs []string) ([]db.File, error) {
 				continue
 			}
 			log.Debugf("Found file with path: %s", filePath)
-			files = append(files, db.File{Created: time.Now(), Path: filePath})
+			files = append(files, db.File{Created: time.Now(), Path: filePath, Size: it.Folder().Size, Checksum: getChecksum(it.Folder())})
 		}
 	}
 	log.Infof("Found %d files on the target directories", len(files))
 	return files, nil
 }
 
+// getChecksum returns the strongest checksum files.com reported for the
+// given entry, prefixed with the algorithm used.
+func getChecksum(entry filessdk.Folder) string {
+	if entry.Md5 != "" {
+		return "md5:" + entry.Md5
+	}
+	if entry.Crc32 != "" {
+		return "crc32:" + entry.Crc32
+	}
+	return ""
+}
+
 func NewFilesComClient(apiKey, endpoint string) (FilesComClient, error) {
 	log.Infof("Creating new files.com client")
 	return &BaseFilesComClient{ApiClient: file.Client{Config: filessdk.Config{APIKey: apiKey, Endpoint: endpoint}}}, nil
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"html"
 	"regexp"
+	"slices"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -19,15 +22,32 @@ func (e ErrNoCaseFound) Error() string {
 	return fmt.Sprintf("no case found in Salesforce with number '%s'", e.number)
 }
 
+type ErrAmbiguousCase struct {
+	number string
+	count  int
+}
+
+func (e ErrAmbiguousCase) Error() string {
+	return fmt.Sprintf("%d cases found in Salesforce with number '%s'", e.count, e.number)
+}
+
 var ErrAuthentication = simpleforce.ErrAuthentication
 
 type SalesforceClient interface {
+	AttachFile(caseId, fileName string, content []byte, visibility string) (*Attachment, error)
+	CreateTask(caseId, subject, description string) (string, error)
+	DeleteComment(id string, chatter bool) error
 	DescribeGlobal() (*simpleforce.SObjectMeta, error)
 	GetCaseByNumber(number string) (*Case, error)
+	GetCasesByNumbers(numbers []string) (map[string]*Case, error)
+	GetLoc() string
 	PostChatter(caseId, body string, isPublic bool) *simpleforce.SObject
 	PostComment(caseId, body string, isPublic bool) *simpleforce.SObject
+	PostComments(comments []Comment, chatter bool) ([]CommentResult, error)
 	Query(query string) (*simpleforce.QueryResult, error)
 	SObject(objectName ...string) *simpleforce.SObject
+	UpdateCase(caseId string, fields map[string]string) error
+	UpdateComment(id, body string, chatter bool) error
 }
 
 type SalesforceClientFactory interface {
@@ -36,29 +56,125 @@ type SalesforceClientFactory interface {
 
 type BaseSalesforceClient struct {
 	*simpleforce.Client
+	CaseFields []string // Additional case fields to fetch in GetCaseByNumber
+	transport  *sessionTransport
 }
 
-type BaseSalesforceClientFactory struct{}
+// BaseSalesforceClientFactory logs in to Salesforce once and shares the
+// session between all callers of the process. Every caller gets its own
+// client since simpleforce clients must not be used concurrently.
+type BaseSalesforceClientFactory struct {
+	mu        sync.Mutex
+	transport *sessionTransport
+}
 
-func NewSalesforceClient(config *config.Config) (SalesforceClient, error) {
-	log.Infof("Creating new Salesforce client")
+// loginSalesforce logs in to Salesforce and returns the transport holding
+// the session.
+func loginSalesforce(config *config.Config) (*sessionTransport, error) {
+	log.Infof("Logging in to Salesforce")
 	client := simpleforce.NewClient(config.Salesforce.Endpoint, simpleforce.DefaultClientID, simpleforce.DefaultAPIVersion)
-	if err := client.LoginPassword(config.Salesforce.Username, config.Salesforce.Password, config.Salesforce.SecurityToken); err != nil {
+	authenticator, err := NewSalesforceAuthenticator(&config.Salesforce)
+	if err != nil {
+		return nil, err
+	}
+	if err := authenticator.Authenticate(client); err != nil {
+		return nil, err
+	}
+	var backoff time.Duration
+	if config.Salesforce.APILimitBackoff != "" {
+		backoff, err = time.ParseDuration(config.Salesforce.APILimitBackoff)
+		if err != nil {
+			return nil, fmt.Errorf("invalid salesforce.api-limit-backoff '%s': %s", config.Salesforce.APILimitBackoff, err)
+		}
+	}
+	// The session transport authenticates again when the session expires
+	// instead of failing all further requests with an authentication error.
+	return newSessionTransport(client, config.Salesforce.Endpoint, authenticator, config.Salesforce.APIUsageLimit, backoff), nil
+}
+
+// newBaseSalesforceClient returns a new client using the session of the
+// transport.
+func newBaseSalesforceClient(config *config.Config, transport *sessionTransport) *BaseSalesforceClient {
+	log.Debugf("Creating new Salesforce client")
+	return &BaseSalesforceClient{Client: transport.newClient(), CaseFields: config.Monitor.CaseFields(), transport: transport}
+}
+
+func NewSalesforceClient(config *config.Config) (SalesforceClient, error) {
+	transport, err := loginSalesforce(config)
+	if err != nil {
 		return nil, err
 	}
-	return &BaseSalesforceClient{client}, nil
+	return newBaseSalesforceClient(config, transport), nil
 }
 
+// NewSalesforceClient returns a new client using the shared session, logging
+// in on first use.
 func (sf *BaseSalesforceClientFactory) NewSalesforceClient(config *config.Config) (SalesforceClient, error) {
-	return NewSalesforceClient(config)
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.transport == nil {
+		transport, err := loginSalesforce(config)
+		if err != nil {
+			return nil, err
+		}
+		sf.transport = transport
+	}
+	return newBaseSalesforceClient(config, sf.transport), nil
+}
+
+// GetLoc returns the instance URL of the current session, which changes when
+// the transport logs in again.
+func (sf *BaseSalesforceClient) GetLoc() string {
+	if sf.transport == nil {
+		return sf.Client.GetLoc()
+	}
+	return sf.transport.InstanceURL()
 }
 
 type Case struct {
 	Id, CaseNumber, AccountId, Customer string
+	Fields                              map[string]string // Additional case fields, e.g. Status
+}
+
+// caseQueryFields returns the list of fields selected when fetching a case.
+func (sf *BaseSalesforceClient) caseQueryFields() []string {
+	fields := []string{"Id", "CaseNumber", "AccountId", "Account.Name"}
+	for _, field := range sf.CaseFields {
+		if !slices.Contains(fields, field) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// caseFromRecord converts a record selected with caseQueryFields into a Case.
+func (sf *BaseSalesforceClient) caseFromRecord(record *simpleforce.SObject) *Case {
+	var customer string
+	if account, ok := record.InterfaceField("Account").(map[string]interface{}); ok {
+		customer, _ = account["Name"].(string)
+	}
+	fields := make(map[string]string)
+	for _, field := range sf.CaseFields {
+		fields[field] = record.StringField(field)
+	}
+	return &Case{
+		Id:         record.StringField("Id"),
+		CaseNumber: record.StringField("CaseNumber"),
+		AccountId:  record.StringField("AccountId"),
+		Customer:   customer,
+		Fields:     fields,
+	}
 }
 
 func (sf *BaseSalesforceClient) GetCaseByNumber(number string) (*Case, error) {
-	q := "SELECT Id,CaseNumber,AccountId FROM Case WHERE CaseNumber LIKE '%" + number + "%'"
+	normalized, err := NormalizeCaseNumber(number)
+	if err != nil {
+		return nil, err
+	}
+	q, err := NewSOQLQuery("Case", sf.caseQueryFields()...).Where("CaseNumber", "=", normalized).Build()
+	if err != nil {
+		return nil, err
+	}
 	result, err := sf.Query(q)
 	if err != nil {
 		if err == simpleforce.ErrAuthentication {
@@ -67,18 +183,71 @@ func (sf *BaseSalesforceClient) GetCaseByNumber(number string) (*Case, error) {
 		return nil, err
 	}
 
-	for _, record := range result.Records {
-		account := sf.SObject("Account").Get(record.StringField("AccountId"))
-		if account != nil {
-			return &Case{
-				Id:         record.StringField("Id"),
-				CaseNumber: record.StringField("CaseNumber"),
-				AccountId:  record.StringField("AccountId"),
-				Customer:   account.StringField("Name"),
-			}, nil
+	switch len(result.Records) {
+	case 0:
+		return nil, ErrNoCaseFound{number}
+	case 1:
+		return sf.caseFromRecord(&result.Records[0]), nil
+	default:
+		return nil, ErrAmbiguousCase{number: number, count: len(result.Records)}
+	}
+}
+
+// maxCasesPerQuery limits the number of case numbers looked up with a single
+// query to keep the query URL reasonably short.
+const maxCasesPerQuery = 200
+
+// GetCasesByNumbers looks up many cases with as few queries as possible. The
+// returned map is keyed by the requested case numbers; case numbers which
+// were not found, or which match several cases like for GetCaseByNumber, are
+// missing from the map.
+func (sf *BaseSalesforceClient) GetCasesByNumbers(numbers []string) (map[string]*Case, error) {
+	var results = make(map[string]*Case)
+	var requested = make(map[string][]string)
+	var matches = make(map[string][]*Case)
+	var normalizedNumbers []string
+
+	for _, number := range numbers {
+		normalized, err := NormalizeCaseNumber(number)
+		if err != nil {
+			log.Warnf("Ignoring case number: %s", err)
+			continue
+		}
+		if _, ok := requested[normalized]; !ok {
+			normalizedNumbers = append(normalizedNumbers, normalized)
 		}
+		requested[normalized] = append(requested[normalized], number)
 	}
-	return nil, ErrNoCaseFound{number}
+
+	for start := 0; start < len(normalizedNumbers); start += maxCasesPerQuery {
+		chunk := normalizedNumbers[start:min(start+maxCasesPerQuery, len(normalizedNumbers))]
+		q, err := NewSOQLQuery("Case", sf.caseQueryFields()...).WhereIn("CaseNumber", chunk).Build()
+		if err != nil {
+			return nil, err
+		}
+		result, err := sf.Query(q)
+		if err != nil {
+			if err == simpleforce.ErrAuthentication {
+				return nil, ErrAuthentication
+			}
+			return nil, err
+		}
+		for _, record := range result.Records {
+			sfCase := sf.caseFromRecord(&record)
+			matches[sfCase.CaseNumber] = append(matches[sfCase.CaseNumber], sfCase)
+		}
+	}
+
+	for normalized, cases := range matches {
+		if len(cases) > 1 {
+			log.Warnf("Ignoring case number: %s", ErrAmbiguousCase{number: normalized, count: len(cases)})
+			continue
+		}
+		for _, number := range requested[normalized] {
+			results[number] = cases[0]
+		}
+	}
+	return results, nil
 }
 
 func (sf *BaseSalesforceClient) PostComment(caseId, body string, isPublic bool) *simpleforce.SObject {
@@ -133,3 +302,30 @@ func GetCaseNumberFromFilename(filename string) (string, error) {
 
 	return "", fmt.Errorf("failed to identify case number from filename '%s'", filename)
 }
+
+// UpdateCase sets the given fields of the case.
+func (sf *BaseSalesforceClient) UpdateCase(caseId string, fields map[string]string) error {
+	log.Debugf("Updating fields of case %s", caseId)
+	sfCase := sf.SObject("Case").Set("Id", caseId)
+	for field, value := range fields {
+		sfCase.Set(field, value)
+	}
+	if sfCase.Update() == nil {
+		return fmt.Errorf("failed to update case '%s'", caseId)
+	}
+	return nil
+}
+
+// CreateTask creates a task related to the case and returns its ID.
+func (sf *BaseSalesforceClient) CreateTask(caseId, subject, description string) (string, error) {
+	log.Debugf("Creating task for case %s", caseId)
+	task := sf.SObject("Task").
+		Set("WhatId", caseId).
+		Set("Subject", subject).
+		Set("Description", description).
+		Create()
+	if task == nil {
+		return "", fmt.Errorf("failed to create task for case '%s'", caseId)
+	}
+	return task.ID(), nil
+}
@@ -0,0 +1,178 @@
+package common
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/canonical/athena-core/pkg/config"
+	"github.com/simpleforce/simpleforce"
+)
+
+// SalesforceAuthenticator logs a Salesforce client in.
+type SalesforceAuthenticator interface {
+	Authenticate(client *simpleforce.Client) error
+}
+
+type passwordAuthenticator struct {
+	username, password, securityToken string
+}
+
+func (a *passwordAuthenticator) Authenticate(client *simpleforce.Client) error {
+	return client.LoginPassword(a.username, a.password, a.securityToken)
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	InstanceURL      string `json:"instance_url"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// requestToken requests an access token from the OAuth2 token endpoint and
+// stores it in the client.
+func requestToken(client *simpleforce.Client, tokenURL string, form url.Values) error {
+	// Do not use the client's HTTP client which retries on authentication
+	// failures.
+	resp, err := http.PostForm(tokenURL, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return fmt.Errorf("failed to parse token response (status %d): %s", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return fmt.Errorf("failed to get access token (status %d): %s %s", resp.StatusCode, token.Error, token.ErrorDescription)
+	}
+	client.SetSidLoc(token.AccessToken, strings.TrimRight(token.InstanceURL, "/"))
+	return nil
+}
+
+type jwtAuthenticator struct {
+	tokenURL, clientID, username, audience string
+	key                                    *rsa.PrivateKey
+}
+
+// newAssertion returns a signed JWT for the OAuth2 JWT bearer flow.
+func (a *jwtAuthenticator) newAssertion(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss": a.clientID,
+		"sub": a.username,
+		"aud": a.audience,
+		"exp": now.Add(3 * time.Minute).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (a *jwtAuthenticator) Authenticate(client *simpleforce.Client) error {
+	assertion, err := a.newAssertion(time.Now())
+	if err != nil {
+		return err
+	}
+	return requestToken(client, a.tokenURL, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+}
+
+type clientCredentialsAuthenticator struct {
+	tokenURL, clientID, clientSecret string
+}
+
+func (a *clientCredentialsAuthenticator) Authenticate(client *simpleforce.Client) error {
+	return requestToken(client, a.tokenURL, url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {a.clientID},
+		"client_secret": {a.clientSecret},
+	})
+}
+
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded private key found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %s", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// NewSalesforceAuthenticator returns the authenticator for the configured
+// salesforce.auth-flow.
+func NewSalesforceAuthenticator(cfg *config.SalesForce) (SalesforceAuthenticator, error) {
+	tokenURL := strings.TrimRight(cfg.Endpoint, "/") + "/services/oauth2/token"
+	switch cfg.AuthFlow {
+	case "", "password":
+		return &passwordAuthenticator{username: cfg.Username, password: cfg.Password, securityToken: cfg.SecurityToken}, nil
+	case "jwt":
+		if cfg.ClientID == "" || cfg.Username == "" {
+			return nil, fmt.Errorf("the jwt flow requires client-id and username")
+		}
+		keyData := []byte(cfg.PrivateKey)
+		if cfg.PrivateKeyFile != "" {
+			var err error
+			keyData, err = os.ReadFile(cfg.PrivateKeyFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		key, err := parsePrivateKey(keyData)
+		if err != nil {
+			return nil, err
+		}
+		audience := cfg.Audience
+		if audience == "" {
+			audience = simpleforce.DefaultURL
+		}
+		return &jwtAuthenticator{tokenURL: tokenURL, clientID: cfg.ClientID, username: cfg.Username, audience: audience, key: key}, nil
+	case "client-credentials":
+		if cfg.ClientID == "" || cfg.ClientSecret == "" {
+			return nil, fmt.Errorf("the client-credentials flow requires client-id and client-secret")
+		}
+		return &clientCredentialsAuthenticator{tokenURL: tokenURL, clientID: cfg.ClientID, clientSecret: cfg.ClientSecret}, nil
+	default:
+		return nil, fmt.Errorf("unknown Salesforce auth-flow '%s'", cfg.AuthFlow)
+	}
+}
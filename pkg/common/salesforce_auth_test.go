@@ -0,0 +1,145 @@
+package common
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canonical/athena-core/pkg/config"
+	"github.com/simpleforce/simpleforce"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPrivateKey(t *testing.T) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	encoded := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return key, string(encoded)
+}
+
+// tokenHandler serves the OAuth2 token endpoint, handing out the given access
+// token if the request passes the check.
+func tokenHandler(t *testing.T, check func(r *http.Request) bool, instanceURL *string, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/services/oauth2/token", r.URL.Path)
+		assert.Nil(t, r.ParseForm())
+		if !check(r) {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "rejected"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"access_token": token, "instance_url": *instanceURL})
+	}
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	key, encoded := newTestPrivateKey(t)
+	var instanceURL string
+	server := httptest.NewServer(tokenHandler(t, func(r *http.Request) bool {
+		if r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			return false
+		}
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		if len(parts) != 3 {
+			return false
+		}
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		assert.Nil(t, err)
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature) != nil {
+			return false
+		}
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		assert.Nil(t, err)
+		var claims map[string]interface{}
+		assert.Nil(t, json.Unmarshal(payload, &claims))
+		return claims["iss"] == "client" && claims["sub"] == "user@example.com" && claims["aud"] == "https://test.salesforce.com" &&
+			int64(claims["exp"].(float64)) > time.Now().Unix()
+	}, &instanceURL, "jwt-token"))
+	defer server.Close()
+	instanceURL = server.URL + "/"
+
+	authenticator, err := NewSalesforceAuthenticator(&config.SalesForce{
+		AuthFlow:   "jwt",
+		Endpoint:   server.URL,
+		Audience:   "https://test.salesforce.com",
+		ClientID:   "client",
+		Username:   "user@example.com",
+		PrivateKey: encoded,
+	})
+	assert.Nil(t, err)
+
+	client := simpleforce.NewClient(server.URL, simpleforce.DefaultClientID, simpleforce.DefaultAPIVersion)
+	assert.Nil(t, authenticator.Authenticate(client))
+	assert.Equal(t, "jwt-token", client.GetSid())
+	assert.Equal(t, server.URL, client.GetLoc())
+
+	// A key which does not match the one registered with the connected app.
+	_, other := newTestPrivateKey(t)
+	authenticator, err = NewSalesforceAuthenticator(&config.SalesForce{
+		AuthFlow:   "jwt",
+		Endpoint:   server.URL,
+		Audience:   "https://test.salesforce.com",
+		ClientID:   "client",
+		Username:   "user@example.com",
+		PrivateKey: other,
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, authenticator.Authenticate(client))
+}
+
+func TestClientCredentialsAuthenticator(t *testing.T) {
+	var instanceURL string
+	server := httptest.NewServer(tokenHandler(t, func(r *http.Request) bool {
+		return r.Form.Get("grant_type") == "client_credentials" &&
+			r.Form.Get("client_id") == "client" && r.Form.Get("client_secret") == "secret"
+	}, &instanceURL, "cc-token"))
+	defer server.Close()
+	instanceURL = server.URL
+
+	authenticator, err := NewSalesforceAuthenticator(&config.SalesForce{
+		AuthFlow:     "client-credentials",
+		Endpoint:     server.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+	})
+	assert.Nil(t, err)
+
+	client := simpleforce.NewClient(server.URL, simpleforce.DefaultClientID, simpleforce.DefaultAPIVersion)
+	assert.Nil(t, authenticator.Authenticate(client))
+	assert.Equal(t, "cc-token", client.GetSid())
+}
+
+func TestNewSalesforceAuthenticatorInvalid(t *testing.T) {
+	for _, cfg := range []config.SalesForce{
+		{AuthFlow: "saml"},
+		{AuthFlow: "jwt", ClientID: "client", Username: "user"},
+		{AuthFlow: "jwt", ClientID: "client", Username: "user", PrivateKey: "not a key"},
+		{AuthFlow: "jwt", Username: "user"},
+		{AuthFlow: "client-credentials", ClientID: "client"},
+	} {
+		_, err := NewSalesforceAuthenticator(&cfg)
+		assert.NotNil(t, err, cfg.AuthFlow)
+	}
+}
+
+type countingAuthenticator struct {
+	calls       int
+	instanceURL string // Instance URL of the fresh session
+}
+
+func (a *countingAuthenticator) Authenticate(client *simpleforce.Client) error {
+	a.calls++
+	client.SetSidLoc("fresh", a.instanceURL)
+	return nil
+}
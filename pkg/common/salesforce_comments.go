@@ -0,0 +1,142 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/simpleforce/simpleforce"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxRecordsPerCollection is the maximum number of records the sObject
+// Collections API accepts per request.
+const maxRecordsPerCollection = 200
+
+// Comment is a comment to be posted on a case.
+type Comment struct {
+	CaseID   string
+	Body     string
+	IsPublic bool
+}
+
+// CommentResult is the outcome of posting a single comment.
+type CommentResult struct {
+	ID      string
+	Success bool
+	Error   string
+}
+
+type collectionError struct {
+	StatusCode string   `json:"statusCode"`
+	Message    string   `json:"message"`
+	Fields     []string `json:"fields"`
+}
+
+type collectionResult struct {
+	ID      string            `json:"id"`
+	Success bool              `json:"success"`
+	Errors  []collectionError `json:"errors"`
+}
+
+// commentRecord returns the sObject Collections record for the comment, either
+// a CaseComment or a FeedItem if posting to chatter.
+func commentRecord(comment Comment, chatter bool) map[string]interface{} {
+	if chatter {
+		visibility := "InternalUsers"
+		if comment.IsPublic {
+			visibility = "AllUsers"
+		}
+		return map[string]interface{}{
+			"attributes": map[string]string{"type": "FeedItem"},
+			"ParentId":   comment.CaseID,
+			"Body":       comment.Body,
+			"Visibility": visibility,
+		}
+	}
+	return map[string]interface{}{
+		"attributes":  map[string]string{"type": "CaseComment"},
+		"ParentId":    comment.CaseID,
+		"CommentBody": html.UnescapeString(comment.Body),
+		"IsPublished": comment.IsPublic,
+	}
+}
+
+// PostComments creates the comments with the sObject Collections API, up to
+// 200 per request. The results are returned in the order of the comments. A
+// comment which fails does not prevent the others from being posted. An
+// error is only returned if a request as a whole failed, in which case the
+// results of the comments not submitted are marked as failed.
+func (sf *BaseSalesforceClient) PostComments(comments []Comment, chatter bool) ([]CommentResult, error) {
+	results := make([]CommentResult, len(comments))
+	path := fmt.Sprintf("services/data/v%s/composite/sobjects", strings.TrimPrefix(simpleforce.DefaultAPIVersion, "v"))
+
+	for start := 0; start < len(comments); start += maxRecordsPerCollection {
+		chunk := comments[start:min(start+maxRecordsPerCollection, len(comments))]
+		records := make([]map[string]interface{}, 0, len(chunk))
+		for _, comment := range chunk {
+			records = append(records, commentRecord(comment, chatter))
+		}
+		body, err := json.Marshal(map[string]interface{}{"allOrNone": false, "records": records})
+		if err != nil {
+			return results, err
+		}
+
+		log.Debugf("Posting %d comment(s) with the sObject Collections API", len(chunk))
+		data, err := sf.ApexREST("POST", path, bytes.NewReader(body))
+		if err == nil {
+			var collection []collectionResult
+			if err = json.Unmarshal(data, &collection); err == nil && len(collection) != len(chunk) {
+				err = fmt.Errorf("expected %d results, got %d", len(chunk), len(collection))
+			}
+			for i := range collection {
+				if i >= len(chunk) {
+					break
+				}
+				results[start+i] = CommentResult{ID: collection[i].ID, Success: collection[i].Success}
+				for _, e := range collection[i].Errors {
+					results[start+i].Error = strings.TrimSpace(results[start+i].Error + " " + e.StatusCode + ": " + e.Message)
+				}
+			}
+		}
+		if err != nil {
+			for i := start; i < len(comments); i++ {
+				if !results[i].Success && results[i].Error == "" {
+					results[i].Error = err.Error()
+				}
+			}
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// commentObject returns the sObject type and body field of a comment.
+func commentObject(chatter bool) (string, string) {
+	if chatter {
+		return "FeedItem", "Body"
+	}
+	return "CaseComment", "CommentBody"
+}
+
+// UpdateComment replaces the text of a comment posted earlier.
+func (sf *BaseSalesforceClient) UpdateComment(id, body string, chatter bool) error {
+	objectType, field := commentObject(chatter)
+	log.Debugf("Updating %s %s", objectType, id)
+	if !chatter {
+		body = html.UnescapeString(body)
+	}
+	if sf.SObject(objectType).Set("Id", id).Set(field, body).Update() == nil {
+		return fmt.Errorf("failed to update %s '%s'", objectType, id)
+	}
+	return nil
+}
+
+// DeleteComment deletes a comment posted earlier.
+func (sf *BaseSalesforceClient) DeleteComment(id string, chatter bool) error {
+	objectType, _ := commentObject(chatter)
+	log.Debugf("Deleting %s %s", objectType, id)
+	return sf.SObject(objectType).Set("Id", id).Delete()
+}
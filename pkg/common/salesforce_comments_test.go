@@ -0,0 +1,62 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostComments(t *testing.T) {
+	var sizes []int
+	client := newTestSalesforceClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/services/data/v54.0/composite/sobjects", r.URL.Path)
+		var request struct {
+			AllOrNone bool                     `json:"allOrNone"`
+			Records   []map[string]interface{} `json:"records"`
+		}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&request))
+		assert.False(t, request.AllOrNone)
+		sizes = append(sizes, len(request.Records))
+
+		var results []collectionResult
+		for i, record := range request.Records {
+			assert.Equal(t, "CaseComment", record["attributes"].(map[string]interface{})["type"])
+			if record["ParentId"] == "bad" {
+				results = append(results, collectionResult{Errors: []collectionError{{StatusCode: "INVALID_ID_FIELD", Message: "invalid id"}}})
+				continue
+			}
+			results = append(results, collectionResult{ID: fmt.Sprintf("%d-%d", len(sizes), i), Success: true})
+		}
+		assert.Nil(t, json.NewEncoder(w).Encode(results))
+	})
+
+	var comments []Comment
+	for i := 0; i < 250; i++ {
+		comments = append(comments, Comment{CaseID: "5001", Body: "comment"})
+	}
+	comments[210].CaseID = "bad"
+
+	results, err := client.PostComments(comments, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{200, 50}, sizes)
+	assert.Len(t, results, 250)
+	assert.Equal(t, CommentResult{ID: "1-0", Success: true}, results[0])
+	assert.Equal(t, CommentResult{ID: "2-0", Success: true}, results[200])
+	assert.Equal(t, CommentResult{Error: "INVALID_ID_FIELD: invalid id"}, results[210])
+}
+
+func TestPostCommentsRequestFailure(t *testing.T) {
+	client := newTestSalesforceClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`[{"errorCode":"UNKNOWN_EXCEPTION","message":"boom"}]`))
+	})
+
+	results, err := client.PostComments([]Comment{{CaseID: "5001", Body: "comment"}}, true)
+	assert.NotNil(t, err)
+	assert.False(t, results[0].Success)
+	assert.NotEmpty(t, results[0].Error)
+}
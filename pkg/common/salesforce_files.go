@@ -0,0 +1,57 @@
+package common
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Attachment is a file uploaded to Salesforce and linked to a case.
+type Attachment struct {
+	ContentVersionID  string
+	ContentDocumentID string
+}
+
+// AttachFile uploads the content as a ContentVersion and links the resulting
+// document to the case with the given visibility, AllUsers or InternalUsers.
+func (sf *BaseSalesforceClient) AttachFile(caseId, fileName string, content []byte, visibility string) (*Attachment, error) {
+	if visibility == "" {
+		visibility = "InternalUsers"
+	}
+
+	log.Debugf("Uploading %s (%d bytes) to case %s", fileName, len(content), caseId)
+	version := sf.SObject("ContentVersion").
+		Set("Title", fileName).
+		Set("PathOnClient", fileName).
+		Set("VersionData", base64.StdEncoding.EncodeToString(content)).
+		Create()
+	if version == nil {
+		return nil, fmt.Errorf("failed to upload '%s'", fileName)
+	}
+	attachment := &Attachment{ContentVersionID: version.ID()}
+
+	q, err := NewSOQLQuery("ContentVersion", "ContentDocumentId").Where("Id", "=", attachment.ContentVersionID).Build()
+	if err != nil {
+		return nil, err
+	}
+	result, err := sf.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Records) != 1 {
+		return nil, fmt.Errorf("content version '%s' not found", attachment.ContentVersionID)
+	}
+	attachment.ContentDocumentID = result.Records[0].StringField("ContentDocumentId")
+
+	link := sf.SObject("ContentDocumentLink").
+		Set("ContentDocumentId", attachment.ContentDocumentID).
+		Set("LinkedEntityId", caseId).
+		Set("ShareType", "V").
+		Set("Visibility", visibility).
+		Create()
+	if link == nil {
+		return nil, fmt.Errorf("failed to link '%s' to case '%s'", fileName, caseId)
+	}
+	return attachment, nil
+}
@@ -0,0 +1,46 @@
+package common
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttachFile(t *testing.T) {
+	created := make(map[string]map[string]interface{})
+	client := newTestSalesforceClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/services/data/v54.0/sobjects/ContentVersion/", "/services/data/v54.0/sobjects/ContentDocumentLink/":
+			var record map[string]interface{}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&record))
+			if _, ok := record["VersionData"]; ok {
+				created["ContentVersion"] = record
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": "068A", "success": true})
+			} else {
+				created["ContentDocumentLink"] = record
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": "06AA", "success": true})
+			}
+		case "/services/data/v54.0/query":
+			assert.Equal(t, "SELECT ContentDocumentId FROM ContentVersion WHERE Id = '068A'", r.URL.Query().Get("q"))
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"totalSize": 1,
+				"done":      true,
+				"records":   []map[string]interface{}{{"ContentDocumentId": "069A"}},
+			})
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	})
+
+	attachment, err := client.AttachFile("5001", "hotsos.txt", []byte("output"), "")
+	assert.Nil(t, err)
+	assert.Equal(t, &Attachment{ContentVersionID: "068A", ContentDocumentID: "069A"}, attachment)
+	assert.Equal(t, "hotsos.txt", created["ContentVersion"]["PathOnClient"])
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("output")), created["ContentVersion"]["VersionData"])
+	assert.Equal(t, "069A", created["ContentDocumentLink"]["ContentDocumentId"])
+	assert.Equal(t, "5001", created["ContentDocumentLink"]["LinkedEntityId"])
+	assert.Equal(t, "InternalUsers", created["ContentDocumentLink"]["Visibility"])
+}
@@ -0,0 +1,190 @@
+package common
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleforce/simpleforce"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrAPILimitReached is returned instead of sending a request while the
+// configured share of the daily Salesforce API limit is used up.
+var ErrAPILimitReached = errors.New("salesforce API usage limit reached")
+
+var apiUsagePattern = regexp.MustCompile(`api-usage=(\d+)/(\d+)`)
+
+// defaultAPILimitBackoff is how long requests are paused once the usage limit
+// is reached if no api-limit-backoff is configured.
+const defaultAPILimitBackoff = 5 * time.Minute
+
+// sessionTransport shares one Salesforce session between all requests of a
+// client. When Salesforce rejects the session, e.g. because the access token
+// expired, it logs in again and retries the request once. It also tracks the
+// API usage reported in the Sforce-Limit-Info header and stops sending
+// requests for a while once the usage limit is reached.
+type sessionTransport struct {
+	base          http.RoundTripper
+	endpoint      string
+	authenticator SalesforceAuthenticator
+	usageLimit    int // Percentage of the API limit which may be used
+	backoff       time.Duration
+
+	mu           sync.Mutex
+	session      string
+	instanceURL  string
+	apiUsed      int
+	apiMax       int
+	limitedUntil time.Time
+}
+
+func newSessionTransport(client *simpleforce.Client, endpoint string, authenticator SalesforceAuthenticator, usageLimit int, backoff time.Duration) *sessionTransport {
+	if backoff <= 0 {
+		backoff = defaultAPILimitBackoff
+	}
+	return &sessionTransport{
+		base:          http.DefaultTransport,
+		endpoint:      endpoint,
+		authenticator: authenticator,
+		usageLimit:    usageLimit,
+		backoff:       backoff,
+		session:       client.GetSid(),
+		instanceURL:   client.GetLoc(),
+	}
+}
+
+// current returns the session and instance URL to use for the next request.
+func (t *sessionTransport) current() (string, string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Now().Before(t.limitedUntil) {
+		return "", "", ErrAPILimitReached
+	}
+	return t.session, t.instanceURL, nil
+}
+
+// InstanceURL returns the instance URL of the current session.
+func (t *sessionTransport) InstanceURL() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.instanceURL
+}
+
+// newClient returns a client sending its requests through the transport.
+// simpleforce clients modify themselves while building URLs, so clients
+// must not be shared between goroutines; they share the session instead.
+func (t *sessionTransport) newClient() *simpleforce.Client {
+	t.mu.Lock()
+	session, instanceURL := t.session, t.instanceURL
+	t.mu.Unlock()
+	client := simpleforce.NewClient(t.endpoint, simpleforce.DefaultClientID, simpleforce.DefaultAPIVersion)
+	client.SetSidLoc(session, instanceURL)
+	client.SetHttpClient(&http.Client{Transport: t})
+	return client
+}
+
+// reauthenticate logs in again unless another request already did so since
+// the rejected session was used. The clients are never modified, their
+// requests pick up the new session from the transport.
+func (t *sessionTransport) reauthenticate(rejected string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.session != rejected {
+		return nil
+	}
+	log.Infof("Salesforce session expired, authenticating again")
+	client := simpleforce.NewClient(t.endpoint, simpleforce.DefaultClientID, simpleforce.DefaultAPIVersion)
+	if err := t.authenticator.Authenticate(client); err != nil {
+		return err
+	}
+	t.session = client.GetSid()
+	t.instanceURL = client.GetLoc()
+	return nil
+}
+
+// updateUsage records the API usage reported by Salesforce.
+func (t *sessionTransport) updateUsage(resp *http.Response) {
+	match := apiUsagePattern.FindStringSubmatch(resp.Header.Get("Sforce-Limit-Info"))
+	if match == nil {
+		return
+	}
+	used, _ := strconv.Atoi(match[1])
+	max, _ := strconv.Atoi(match[2])
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.apiUsed, t.apiMax = used, max
+	if t.usageLimit > 0 && max > 0 && used*100 >= max*t.usageLimit {
+		log.Warnf("Used %d of %d Salesforce API requests, pausing requests for %s", used, max, t.backoff)
+		t.limitedUntil = time.Now().Add(t.backoff)
+	}
+}
+
+// prepare returns a copy of the request using the session and instance URL.
+func prepare(req *http.Request, session, instanceURL string) (*http.Request, error) {
+	prepared := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		prepared.Body = body
+	}
+	prepared.Header.Set("Authorization", "Bearer "+session)
+	if instance, err := url.Parse(instanceURL); err == nil && instance.Host != "" {
+		prepared.URL.Scheme = instance.Scheme
+		prepared.URL.Host = instance.Host
+		prepared.Host = ""
+	}
+	return prepared, nil
+}
+
+func (t *sessionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Requests without a session, i.e. logins, are passed on unchanged.
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+		return t.base.RoundTrip(req)
+	}
+
+	session, instanceURL, err := t.current()
+	if err != nil {
+		return nil, err
+	}
+	prepared, err := prepare(req, session, instanceURL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(prepared)
+	if err != nil {
+		return nil, err
+	}
+	t.updateUsage(resp)
+	if resp.StatusCode != http.StatusUnauthorized || (req.Body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+
+	if err := t.reauthenticate(session); err != nil {
+		log.Errorf("Failed to authenticate with Salesforce again: %s", err)
+		return resp, nil
+	}
+	session, instanceURL, err = t.current()
+	if err != nil {
+		return resp, nil
+	}
+	retry, err := prepare(req, session, instanceURL)
+	if err != nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp, err = t.base.RoundTrip(retry)
+	if err != nil {
+		return nil, err
+	}
+	t.updateUsage(resp)
+	return resp, nil
+}
@@ -0,0 +1,136 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/canonical/athena-core/pkg/config"
+	"github.com/simpleforce/simpleforce"
+	"github.com/stretchr/testify/assert"
+)
+
+// newSessionTestClient returns a client logged in with the given session whose
+// requests go through a sessionTransport.
+func newSessionTestClient(server *httptest.Server, session string, usageLimit int) (*simpleforce.Client, *sessionTransport, *countingAuthenticator) {
+	client := simpleforce.NewClient(server.URL, simpleforce.DefaultClientID, simpleforce.DefaultAPIVersion)
+	client.SetSidLoc(session, server.URL)
+	authenticator := &countingAuthenticator{}
+	transport := newSessionTransport(client, server.URL, authenticator, usageLimit, time.Hour)
+	client.SetHttpClient(&http.Client{Transport: transport})
+	return client, transport, authenticator
+}
+
+func emptyQueryResult(w http.ResponseWriter) {
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"totalSize": 0, "done": true, "records": []interface{}{}})
+}
+
+func TestSessionTransportReauthenticates(t *testing.T) {
+	var mu sync.Mutex
+	var sessions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sessions = append(sessions, r.Header.Get("Authorization"))
+		mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`[{"errorCode":"INVALID_SESSION_ID","message":"Session expired or invalid"}]`))
+			return
+		}
+		emptyQueryResult(w)
+	}))
+	defer server.Close()
+
+	client, transport, authenticator := newSessionTestClient(server, "expired", 0)
+	authenticator.instanceURL = server.URL
+	_, err := client.Query("SELECT Id FROM Case")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Bearer expired", "Bearer fresh"}, sessions)
+	assert.Equal(t, 1, authenticator.calls)
+
+	// Concurrent requests share the new session without logging in again.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := transport.newClient().Query("SELECT Id FROM Case")
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, authenticator.calls)
+	assert.Len(t, sessions, 12)
+}
+
+func TestSessionTransportAPILimit(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Sforce-Limit-Info", "api-usage=95/100")
+		emptyQueryResult(w)
+	}))
+	defer server.Close()
+
+	client, transport, _ := newSessionTestClient(server, "session", 90)
+	_, err := client.Query("SELECT Id FROM Case")
+	assert.Nil(t, err)
+	assert.Equal(t, 95, transport.apiUsed)
+	assert.Equal(t, 100, transport.apiMax)
+
+	_, err = client.Query("SELECT Id FROM Case")
+	assert.ErrorIs(t, err, ErrAPILimitReached)
+	assert.Equal(t, 1, requests)
+
+	// Requests are sent again once the backoff expired.
+	transport.limitedUntil = time.Now()
+	_, err = client.Query("SELECT Id FROM Case")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, requests)
+
+	// Configurations without api-limit-backoff still pause.
+	assert.Equal(t, defaultAPILimitBackoff, newSessionTransport(client, server.URL, nil, 90, 0).backoff)
+}
+
+func TestSalesforceClientFactoryShared(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		emptyQueryResult(w)
+	}))
+	defer server.Close()
+
+	_, transport, authenticator := newSessionTestClient(server, "expired", 0)
+	// The trailing slash tells the new instance URL apart from the old one.
+	authenticator.instanceURL = server.URL + "/"
+	factory := &BaseSalesforceClientFactory{transport: transport}
+
+	// Every caller gets its own client, which may be used concurrently with
+	// the others.
+	var clients []SalesforceClient
+	for i := 0; i < 5; i++ {
+		client, err := factory.NewSalesforceClient(&config.Config{})
+		assert.Nil(t, err)
+		clients = append(clients, client)
+	}
+	assert.NotSame(t, clients[0], clients[1])
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.Query("SELECT Id FROM Case")
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, authenticator.calls)
+
+	// Clients report the instance of the session logged in again.
+	assert.Equal(t, authenticator.instanceURL, clients[0].GetLoc())
+}
@@ -1,8 +1,14 @@
 package common
 
 import (
+	"encoding/json"
 	"errors"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+
+	"github.com/simpleforce/simpleforce"
+	"github.com/stretchr/testify/assert"
 )
 
 const validCaseNumber = "123456"
@@ -72,3 +78,82 @@ func TestGetCaseByNumberAuthentication(t *testing.T) {
 		t.Errorf("Expected nil case details, got %+v", caseDetails)
 	}
 }
+
+// newTestSalesforceClient returns a client talking to a fake Salesforce
+// instance serving the given handler.
+func newTestSalesforceClient(t *testing.T, handler http.HandlerFunc) *BaseSalesforceClient {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	client := simpleforce.NewClient(server.URL, simpleforce.DefaultClientID, simpleforce.DefaultAPIVersion)
+	client.SetSidLoc("session", server.URL)
+	return &BaseSalesforceClient{Client: client}
+}
+
+func queryHandler(t *testing.T, queries *[]string, records ...map[string]interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*queries = append(*queries, r.URL.Query().Get("q"))
+		err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"totalSize": len(records),
+			"done":      true,
+			"records":   records,
+		})
+		assert.Nil(t, err)
+	}
+}
+
+func TestBaseGetCaseByNumber(t *testing.T) {
+	var queries []string
+	client := newTestSalesforceClient(t, queryHandler(t, &queries, map[string]interface{}{
+		"Id":         "5001",
+		"CaseNumber": "00123456",
+		"AccountId":  "0011",
+		"Account":    map[string]interface{}{"Name": "ACME"},
+	}))
+
+	sfCase, err := client.GetCaseByNumber("123456")
+	assert.Nil(t, err)
+	assert.Equal(t, &Case{Id: "5001", CaseNumber: "00123456", AccountId: "0011", Customer: "ACME", Fields: map[string]string{}}, sfCase)
+	assert.Equal(t, []string{"SELECT Id,CaseNumber,AccountId,Account.Name FROM Case WHERE CaseNumber = '00123456'"}, queries)
+
+	_, err = client.GetCaseByNumber("123456' OR CaseNumber LIKE '%")
+	assert.NotNil(t, err)
+	assert.Len(t, queries, 1)
+}
+
+func TestBaseGetCaseByNumberAmbiguous(t *testing.T) {
+	var queries []string
+	client := newTestSalesforceClient(t, queryHandler(t, &queries,
+		map[string]interface{}{"Id": "5001", "CaseNumber": "00123456"},
+		map[string]interface{}{"Id": "5002", "CaseNumber": "00123456"},
+	))
+
+	_, err := client.GetCaseByNumber("123456")
+	assert.ErrorIs(t, err, ErrAmbiguousCase{number: "123456", count: 2})
+}
+
+func TestBaseGetCasesByNumbers(t *testing.T) {
+	var queries []string
+	client := newTestSalesforceClient(t, queryHandler(t, &queries,
+		map[string]interface{}{"Id": "5001", "CaseNumber": "00123456", "Account": map[string]interface{}{"Name": "ACME"}},
+	))
+
+	cases, err := client.GetCasesByNumbers([]string{"123456", "00123456", "234567", "abc"})
+	assert.Nil(t, err)
+	assert.Len(t, cases, 2)
+	assert.Equal(t, "ACME", cases["123456"].Customer)
+	assert.Equal(t, "5001", cases["00123456"].Id)
+	assert.Equal(t, []string{"SELECT Id,CaseNumber,AccountId,Account.Name FROM Case WHERE CaseNumber IN ('00123456','00234567')"}, queries)
+}
+
+func TestBaseGetCasesByNumbersAmbiguous(t *testing.T) {
+	var queries []string
+	client := newTestSalesforceClient(t, queryHandler(t, &queries,
+		map[string]interface{}{"Id": "5001", "CaseNumber": "00123456"},
+		map[string]interface{}{"Id": "5002", "CaseNumber": "00123456"},
+		map[string]interface{}{"Id": "5003", "CaseNumber": "00234567"},
+	))
+
+	cases, err := client.GetCasesByNumbers([]string{"123456", "234567"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]*Case{"234567": {Id: "5003", CaseNumber: "00234567", Fields: map[string]string{}}}, cases)
+}
@@ -0,0 +1,164 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var soqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+
+var soqlOperators = []string{"=", "!=", "<", "<=", ">", ">=", "LIKE"}
+
+var soqlEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`'`, `\'`,
+	`"`, `\"`,
+	"\n", `\n`,
+	"\r", `\r`,
+	"\t", `\t`,
+	"\b", `\b`,
+	"\f", `\f`,
+)
+
+// QuoteSOQL returns the value as a quoted and escaped SOQL string literal.
+func QuoteSOQL(value string) string {
+	return "'" + soqlEscaper.Replace(value) + "'"
+}
+
+type soqlCondition struct {
+	field, operator string
+	values          []string
+}
+
+// SOQLQuery builds SOQL queries with properly escaped values.
+type SOQLQuery struct {
+	object     string
+	fields     []string
+	conditions []soqlCondition
+	orderBy    []string
+	limit      int
+}
+
+// NewSOQLQuery starts a query selecting the fields from the object.
+func NewSOQLQuery(object string, fields ...string) *SOQLQuery {
+	return &SOQLQuery{object: object, fields: fields}
+}
+
+// Where adds a condition comparing the field with the value. Conditions are
+// combined with AND.
+func (q *SOQLQuery) Where(field, operator, value string) *SOQLQuery {
+	q.conditions = append(q.conditions, soqlCondition{field: field, operator: operator, values: []string{value}})
+	return q
+}
+
+// WhereIn adds a condition matching the field against any of the values.
+func (q *SOQLQuery) WhereIn(field string, values []string) *SOQLQuery {
+	q.conditions = append(q.conditions, soqlCondition{field: field, operator: "IN", values: values})
+	return q
+}
+
+// OrderBy sorts the results by the field.
+func (q *SOQLQuery) OrderBy(field string, descending bool) *SOQLQuery {
+	if descending {
+		field += " DESC"
+	}
+	q.orderBy = append(q.orderBy, field)
+	return q
+}
+
+// Limit limits the number of returned records.
+func (q *SOQLQuery) Limit(limit int) *SOQLQuery {
+	q.limit = limit
+	return q
+}
+
+func checkIdentifier(identifier string) error {
+	if !soqlIdentifier.MatchString(identifier) {
+		return fmt.Errorf("invalid SOQL identifier '%s'", identifier)
+	}
+	return nil
+}
+
+// Build returns the query, or an error if an object, field or operator is
+// invalid.
+func (q *SOQLQuery) Build() (string, error) {
+	if err := checkIdentifier(q.object); err != nil {
+		return "", err
+	}
+	if len(q.fields) == 0 {
+		return "", fmt.Errorf("no fields selected from %s", q.object)
+	}
+	for _, field := range q.fields {
+		if err := checkIdentifier(field); err != nil {
+			return "", err
+		}
+	}
+
+	var query strings.Builder
+	query.WriteString("SELECT " + strings.Join(q.fields, ",") + " FROM " + q.object)
+
+	for i, condition := range q.conditions {
+		if err := checkIdentifier(condition.field); err != nil {
+			return "", err
+		}
+		if i == 0 {
+			query.WriteString(" WHERE ")
+		} else {
+			query.WriteString(" AND ")
+		}
+		if condition.operator == "IN" {
+			if len(condition.values) == 0 {
+				return "", fmt.Errorf("no values given for %s IN", condition.field)
+			}
+			var quoted []string
+			for _, value := range condition.values {
+				quoted = append(quoted, QuoteSOQL(value))
+			}
+			query.WriteString(condition.field + " IN (" + strings.Join(quoted, ",") + ")")
+			continue
+		}
+		if !slices.Contains(soqlOperators, condition.operator) {
+			return "", fmt.Errorf("invalid SOQL operator '%s'", condition.operator)
+		}
+		query.WriteString(condition.field + " " + condition.operator + " " + QuoteSOQL(condition.values[0]))
+	}
+
+	if len(q.orderBy) > 0 {
+		for _, field := range q.orderBy {
+			if err := checkIdentifier(strings.TrimSuffix(field, " DESC")); err != nil {
+				return "", err
+			}
+		}
+		query.WriteString(" ORDER BY " + strings.Join(q.orderBy, ","))
+	}
+
+	if q.limit > 0 {
+		query.WriteString(" LIMIT " + strconv.Itoa(q.limit))
+	}
+
+	return query.String(), nil
+}
+
+// caseNumberLength is the length Salesforce zero pads case numbers to.
+const caseNumberLength = 8
+
+// NormalizeCaseNumber returns the case number as stored in Salesforce, i.e.
+// zero padded to 8 digits. Case numbers must only contain digits.
+func NormalizeCaseNumber(number string) (string, error) {
+	number = strings.TrimSpace(number)
+	if number == "" {
+		return "", fmt.Errorf("empty case number")
+	}
+	for _, c := range number {
+		if c < '0' || c > '9' {
+			return "", fmt.Errorf("invalid case number '%s'", number)
+		}
+	}
+	if len(number) < caseNumberLength {
+		number = strings.Repeat("0", caseNumberLength-len(number)) + number
+	}
+	return number, nil
+}
@@ -0,0 +1,61 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuoteSOQL(t *testing.T) {
+	assert.Equal(t, `'123456'`, QuoteSOQL("123456"))
+	assert.Equal(t, `'x\' OR Name LIKE \'%'`, QuoteSOQL("x' OR Name LIKE '%"))
+	assert.Equal(t, `'a\\b\nc'`, QuoteSOQL("a\\b\nc"))
+}
+
+func TestSOQLQuery(t *testing.T) {
+	query, err := NewSOQLQuery("Case", "Id", "CaseNumber", "Account.Name").
+		Where("CaseNumber", "=", "00123456").
+		Where("Status", "!=", "Closed").
+		OrderBy("CreatedDate", true).
+		Limit(10).
+		Build()
+	assert.Nil(t, err)
+	assert.Equal(t, "SELECT Id,CaseNumber,Account.Name FROM Case WHERE CaseNumber = '00123456' AND Status != 'Closed' ORDER BY CreatedDate DESC LIMIT 10", query)
+
+	query, err = NewSOQLQuery("Case", "Id").WhereIn("CaseNumber", []string{"00123456", "0'1"}).Build()
+	assert.Nil(t, err)
+	assert.Equal(t, `SELECT Id FROM Case WHERE CaseNumber IN ('00123456','0\'1')`, query)
+}
+
+func TestSOQLQueryInvalid(t *testing.T) {
+	for _, query := range []*SOQLQuery{
+		NewSOQLQuery("Case"),
+		NewSOQLQuery("Case WHERE", "Id"),
+		NewSOQLQuery("Case", "Id, Name FROM Account"),
+		NewSOQLQuery("Case", "Id").Where("Id", "; DROP", "x"),
+		NewSOQLQuery("Case", "Id").Where("Id = 'x' OR Id", "=", "x"),
+		NewSOQLQuery("Case", "Id").WhereIn("Id", nil),
+		NewSOQLQuery("Case", "Id").OrderBy("Id; x", false),
+	} {
+		_, err := query.Build()
+		assert.NotNil(t, err)
+	}
+}
+
+func TestNormalizeCaseNumber(t *testing.T) {
+	for input, expected := range map[string]string{
+		"123456":    "00123456",
+		"01234567":  "01234567",
+		" 1234567 ": "01234567",
+		"123456789": "123456789",
+	} {
+		number, err := NormalizeCaseNumber(input)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, number)
+	}
+
+	for _, input := range []string{"", "12a456", "123456' OR '1'='1", "-123456"} {
+		_, err := NormalizeCaseNumber(input)
+		assert.NotNil(t, err, input)
+	}
+}
@@ -1,6 +1,7 @@
 package test
 
 import (
+	"fmt"
 	"time"
 
 	files_sdk "github.com/Files-com/files-sdk-go"
@@ -17,6 +18,42 @@ func (sf *SalesforceClient) GetCaseByNumber(number string) (*common.Case, error)
 	return nil, nil
 }
 
+func (sf *SalesforceClient) GetCasesByNumbers(numbers []string) (map[string]*common.Case, error) {
+	return map[string]*common.Case{}, nil
+}
+
+func (sf *SalesforceClient) GetLoc() string {
+	return "https://test.my.salesforce.com"
+}
+
+func (sf *SalesforceClient) PostComments(comments []common.Comment, chatter bool) ([]common.CommentResult, error) {
+	results := make([]common.CommentResult, len(comments))
+	for i := range results {
+		results[i] = common.CommentResult{ID: fmt.Sprintf("comment-%d", i), Success: true}
+	}
+	return results, nil
+}
+
+func (sf *SalesforceClient) UpdateComment(id, body string, chatter bool) error {
+	return nil
+}
+
+func (sf *SalesforceClient) DeleteComment(id string, chatter bool) error {
+	return nil
+}
+
+func (sf *SalesforceClient) AttachFile(caseId, fileName string, content []byte, visibility string) (*common.Attachment, error) {
+	return &common.Attachment{ContentVersionID: "068" + fileName, ContentDocumentID: "069" + fileName}, nil
+}
+
+func (sf *SalesforceClient) UpdateCase(caseId string, fields map[string]string) error {
+	return nil
+}
+
+func (sf *SalesforceClient) CreateTask(caseId, subject, description string) (string, error) {
+	return "00T" + caseId, nil
+}
+
 type SalesforceClientFactory struct{}
 
 func (sf *SalesforceClientFactory) NewSalesforceClient(config *config.Config) (common.SalesforceClient, error) {
@@ -49,3 +86,7 @@ func (fc *FilesComClient) GetFiles(dirs []string) ([]db.File, error) {
 func (fc *FilesComClient) Download(toDownload *db.File, downloadPath string) (*files_sdk.File, error) {
 	return &files_sdk.File{}, nil
 }
+
+func (fc *FilesComClient) Upload(contents, destinationPath string) (*files_sdk.File, error) {
+	return &files_sdk.File{Path: destinationPath, Size: int64(len(contents))}, nil
+}
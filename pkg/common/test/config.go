@@ -37,7 +37,7 @@ processor:
           exit-codes: 0 2 127 126
           script: |
             #!/bin/bash
-            echo ${{filepath}} ${{basedir}} && exit 0
+            echo "$ATHENA_FILEPATH" "$ATHENA_BASEDIR" && exit 0
 
 filescom:
   key: "xxx"
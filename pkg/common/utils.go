@@ -2,6 +2,9 @@ package common
 
 import (
 	"context"
+	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -19,3 +22,29 @@ func RunOnInterval(ctx context.Context, lock *sync.Mutex, d time.Duration, f fun
 		}
 	}
 }
+
+// ParseSize parses a size such as "512", "100K", "20M" or "1G" into bytes.
+func ParseSize(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	value := strings.ToUpper(strings.TrimSpace(size))
+	value = strings.TrimSuffix(value, "B")
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+	result, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || result < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", size)
+	}
+	return result * multiplier, nil
+}
@@ -0,0 +1,24 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	for input, expected := range map[string]int64{
+		"":     0,
+		"512":  512,
+		"10K":  10 << 10,
+		"20MB": 20 << 20,
+		"1g":   1 << 30,
+	} {
+		size, err := ParseSize(input)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, size, input)
+	}
+
+	_, err := ParseSize("lots")
+	assert.NotNil(t, err)
+}
@@ -1,33 +1,126 @@
 package config
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/makyo/snuffler"
 	"gopkg.in/yaml.v3"
 )
 
 type Script struct {
-	Timeout   string `yaml:"timeout" default:"0s"`
-	ExitCodes string `yaml:"exit-codes" default:"any"`
-	Run       string `yaml:"run"`
-	RunScript string
+	Timeout          string   `yaml:"timeout" default:"0s"`
+	ExitCodes        string   `yaml:"exit-codes" default:"any"`     // Exit codes which do not fail the report, e.g. "0 2", or any
+	OutputFormat     string   `yaml:"output-format" default:"text"` // text, json or yaml
+	Run              string   `yaml:"run"`
+	Template         *bool    `yaml:"template"`          // Render run as a template with shell-quoted variables, false runs it as it is
+	UploadStderr     bool     `yaml:"upload-stderr"`     // Upload the standard error next to the output
+	Artifacts        []string `yaml:"artifacts"`         // Globs of files written by the script which are uploaded
+	ArtifactsArchive bool     `yaml:"artifacts-archive"` // Upload the artifacts as a single tar.gz archive
+	RunScript        string
+}
+
+// Sandbox restricts the scripts of a report run with the sandbox runner.
+type Sandbox struct {
+	Command  string   `yaml:"command" default:"bwrap"` // bubblewrap executable
+	Network  bool     `yaml:"network"`                 // Allow network access
+	CPUTime  string   `yaml:"cpu-time"`                // CPU time per script, e.g. 10m
+	Memory   string   `yaml:"memory"`                  // Virtual memory per process, e.g. 4G
+	FileSize string   `yaml:"file-size"`               // Size of the largest file a script may write, e.g. 10G
+	Disk     string   `yaml:"disk"`                    // Size of the work directory and of /tmp, e.g. 20G
+	Binds    []string `yaml:"binds"`                   // Host paths mounted read-only besides the system directories
+}
+
+// Container configures the container the scripts of a report run in with the
+// container runner.
+type Container struct {
+	Runtime string   `yaml:"runtime"` // podman or docker, the first one installed if empty
+	Image   string   `yaml:"image"`   // OCI image, e.g. ghcr.io/canonical/hotsos:latest
+	Network bool     `yaml:"network"` // Allow network access
+	Memory  string   `yaml:"memory"`  // Memory limit, e.g. 4G
+	CPUs    string   `yaml:"cpus"`    // Number of CPUs, e.g. 1.5
+	Options []string `yaml:"options"` // Additional options of the run command
 }
 
 type Report struct {
-	Timeout string            `yaml:"timeout" default:"0s"`
-	Scripts map[string]Script `yaml:"scripts"`
+	Timeout   string            `yaml:"timeout" default:"0s"`
+	Runner    string            `yaml:"runner" default:"host"` // host, sandbox or container
+	Sandbox   Sandbox           `yaml:"sandbox"`
+	Container Container         `yaml:"container"`
+	Scripts   map[string]Script `yaml:"scripts"`
+}
+
+// CustomerFilter lists regular expressions matched against the full account
+// name of a case. If Allow is not empty only matching customers are allowed,
+// and customers matching Deny are never allowed.
+type CustomerFilter struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// Attachments selects script outputs which are attached to the case as
+// Salesforce files.
+type Attachments struct {
+	Scripts    []string `yaml:"scripts"`    // Script names, or report.script
+	MaxSize    string   `yaml:"max-size"`   // Larger outputs are not attached, e.g. 10M
+	Visibility string   `yaml:"visibility"` // AllUsers or InternalUsers
+}
+
+// Condition restricts when a comment is posted or an action runs. The
+// condition matches if any selected script passes all given checks.
+type Condition struct {
+	Report  string `yaml:"report"`   // Only consider scripts of this report, all if empty
+	Script  string `yaml:"script"`   // Only consider this script, all if empty
+	Output  string `yaml:"output"`   // Regex matched against the script output
+	Status  string `yaml:"status"`   // success, failure or an exit code
+	YAMLKey string `yaml:"yaml-key"` // Dotted key which has to be present in the YAML output
+}
+
+// Action is run on the case after the comment for a batch of reports was
+// posted.
+type Action struct {
+	Type     string            `yaml:"type"`     // comment, case-field, status, priority, task or webhook
+	Template string            `yaml:"template"` // Comment, field value, task description or webhook body
+	Field    string            `yaml:"field"`    // Case field set by case-field actions
+	Subject  string            `yaml:"subject"`  // Template of the task subject
+	Public   bool              `yaml:"public"`   // Whether comments are visible to the customer
+	URL      string            `yaml:"url"`      // Webhook URL
+	Headers  map[string]string `yaml:"headers"`  // Webhook request headers
+	When     []Condition       `yaml:"when"`     // All conditions have to match
 }
 
 type Subscriber struct {
-	Topic             string            `yaml:"topic"`
-	SFCommentEnabled  bool              `yaml:"sf-comment-enabled"`
-	SFCommentIsPublic bool              `yaml:"sf-comment-public" default:"false"`
-	SFComment         string            `yaml:"sf-comment"`
-	Reports           map[string]Report `yaml:"reports"`
+	Topic              string            `yaml:"topic"`
+	SFCommentEnabled   bool              `yaml:"sf-comment-enabled"`
+	SFCommentIsPublic  bool              `yaml:"sf-comment-public" default:"false"`
+	SFComment          string            `yaml:"sf-comment"`
+	SFCommentMode      string            `yaml:"sf-comment-mode" default:"append"`    // append, replace or edit
+	SFCommentOverflow  string            `yaml:"sf-comment-overflow" default:"split"` // split, truncate or attach comments which are too long
+	SFCommentCustomers CustomerFilter    `yaml:"sf-comment-customers"`
+	CommentWhen        []Condition       `yaml:"comment-when"` // All conditions have to match to post a comment
+	SFAttachments      Attachments       `yaml:"sf-attachments"`
+	Actions            []Action          `yaml:"actions"`
+	Reports            map[string]Report `yaml:"reports"`
+	UploadPath         string            `yaml:"upload-path"` // Template of the upload path of the script outputs
+}
+
+// CaseNumberStrategy describes one way of extracting a case number from the
+// path of an uploaded file.
+type CaseNumberStrategy struct {
+	Type     string   `yaml:"type"`     // regex, directory or sidecar
+	Patterns []string `yaml:"patterns"` // Regexes with an optional named group "case"
+	Suffix   string   `yaml:"suffix"`   // Suffix of the sidecar metadata file
+	Key      string   `yaml:"key"`      // Key of the case number in the sidecar metadata file
+}
+
+type CaseNumber struct {
+	Strategies []CaseNumberStrategy `yaml:"strategies"`
 }
 
 type Db struct {
-	Dialect string `yaml:"dialect" default:"sqlite"`
-	DSN     string `yaml:"dsn"`
+	Dialect     string `yaml:"dialect" default:"sqlite"`
+	DSN         string `yaml:"dsn"`
+	AutoMigrate bool   `yaml:"auto-migrate"` // Migrate the schema of existing MySQL databases on start
 }
 
 func NewDb() Db {
@@ -36,17 +129,82 @@ func NewDb() Db {
 	}
 }
 
+type ProcessorMapRule struct {
+	Type       string             `yaml:"type"`
+	Regex      string             `yaml:"regex,omitempty"`
+	Field      string             `yaml:"field,omitempty"`
+	MinSize    string             `yaml:"min-size,omitempty"`
+	MaxSize    string             `yaml:"max-size,omitempty"`
+	Extensions []string           `yaml:"extensions,omitempty"`
+	Rules      []ProcessorMapRule `yaml:"rules,omitempty"`
+	Processor  string             `yaml:"processor,omitempty"`
+	Reports    []string           `yaml:"reports,omitempty"` // Reports to run, all if empty
+}
+
+// Describe returns a short description of the rule without the processor it
+// maps to.
+func (rule ProcessorMapRule) Describe() string {
+	switch rule.Type {
+	case "all", "any", "not":
+		var nested []string
+		for _, r := range rule.Rules {
+			nested = append(nested, r.Describe())
+		}
+		return fmt.Sprintf("%s(%s)", rule.Type, strings.Join(nested, ", "))
+	case "case-field":
+		return fmt.Sprintf("%s[%s]:%s", rule.Type, rule.Field, rule.Regex)
+	case "size":
+		return fmt.Sprintf("%s:%s-%s", rule.Type, rule.MinSize, rule.MaxSize)
+	case "extension":
+		return fmt.Sprintf("%s:%s", rule.Type, strings.Join(rule.Extensions, ","))
+	default:
+		return fmt.Sprintf("%s:%s", rule.Type, rule.Regex)
+	}
+}
+
+// String returns a short description of the rule, used to record which rule
+// matched a dispatched file.
+func (rule ProcessorMapRule) String() string {
+	if len(rule.Reports) > 0 {
+		return fmt.Sprintf("%s -> %s[%s]", rule.Describe(), rule.Processor, strings.Join(rule.Reports, ","))
+	}
+	return fmt.Sprintf("%s -> %s", rule.Describe(), rule.Processor)
+}
+
+// CaseFields returns the Salesforce case fields referenced by the rule and
+// its nested rules.
+func (rule ProcessorMapRule) CaseFields() []string {
+	var fields []string
+	if rule.Type == "case-field" && rule.Field != "" {
+		fields = append(fields, rule.Field)
+	}
+	for _, r := range rule.Rules {
+		fields = append(fields, r.CaseFields()...)
+	}
+	return fields
+}
+
 type Monitor struct {
-	PollEvery    string   `yaml:"poll-every"`
-	FilesDelta   string   `yaml:"files-delta"`
-	Filetypes    []string `yaml:"filetypes"`
-	BaseTmpDir   string   `yaml:"base-tmpdir"`
-	Directories  []string `yaml:"directories"`
-	ProcessorMap []struct {
-		Type      string `yaml:"type"`
-		Regex     string `yaml:"regex"`
-		Processor string `yaml:"processor"`
-	} `yaml:"processor-map"`
+	PollEvery    string             `yaml:"poll-every"`
+	FilesDelta   string             `yaml:"files-delta"`
+	Filetypes    []string           `yaml:"filetypes"`
+	BaseTmpDir   string             `yaml:"base-tmpdir"`
+	Directories  []string           `yaml:"directories"`
+	ProcessorMap []ProcessorMapRule `yaml:"processor-map"`
+	Exclude      []ProcessorMapRule `yaml:"exclude"`
+}
+
+// CaseFields returns the Salesforce case fields referenced by the
+// processor-map and exclusion rules.
+func (m *Monitor) CaseFields() []string {
+	var fields []string
+	for _, rule := range m.ProcessorMap {
+		fields = append(fields, rule.CaseFields()...)
+	}
+	for _, rule := range m.Exclude {
+		fields = append(fields, rule.CaseFields()...)
+	}
+	return fields
 }
 
 func NewMonitor() Monitor {
@@ -62,6 +220,7 @@ type Processor struct {
 	BaseTmpDir           string                `yaml:"base-tmpdir"`
 	KeepProcessingOutput bool                  `yaml:"keep-processing-output"`
 	SubscribeTo          map[string]Subscriber `yaml:"subscribers,omitempty"`
+	Templates            map[string]string     `yaml:"templates,omitempty"` // Named templates for {% include %}
 }
 
 func NewProcessor() Processor {
@@ -72,22 +231,39 @@ func NewProcessor() Processor {
 }
 
 type SalesForce struct {
+	APILimitBackoff  string `yaml:"api-limit-backoff"`
+	APIUsageLimit    int    `yaml:"api-usage-limit"` // Percentage of the daily API limit Athena may use
+	Audience         string `yaml:"audience"`
+	AuthFlow         string `yaml:"auth-flow"`
+	CaseCacheTTL     string `yaml:"case-cache-ttl"`
+	ClientID         string `yaml:"client-id"`
+	ClientSecret     string `yaml:"client-secret"`
 	EnableChatter    bool   `yaml:"enable-chatter"`
 	Endpoint         string `yaml:"endpoint"`
+	MaxChatterLength int    `yaml:"max-chatter-length"` // Used instead of max-comment-length for chatter posts
 	MaxCommentLength int    `yaml:"max-comment-length"`
 	Password         string `yaml:"password"`
+	PrivateKey       string `yaml:"private-key"`
+	PrivateKeyFile   string `yaml:"private-key-file"`
 	SecurityToken    string `yaml:"security-token"`
 	Username         string `yaml:"username"`
 }
 
 func NewSalesForce() SalesForce {
 	return SalesForce{
-		MaxCommentLength: 4000 - 1000, // A very conservative buffer of max length per Salesforce comment (4000) without header text for comments
+		APILimitBackoff:  "5m",
+		APIUsageLimit:    90,
+		Audience:         "https://login.salesforce.com",
+		AuthFlow:         "password",
+		CaseCacheTTL:     "15m",
+		MaxCommentLength: 4000 - 1000,  // A very conservative buffer of max length per Salesforce comment (4000) without header text for comments
+		MaxChatterLength: 10000 - 1000, // Same buffer for chatter posts, which are limited to 10000 characters
 		EnableChatter:    false,
 	}
 }
 
 type Config struct {
+	CaseNumber CaseNumber `yaml:"case-number,omitempty"`
 	Db         Db         `yaml:"db,omitempty"`
 	Monitor    Monitor    `yaml:"monitor,omitempty"`
 	Processor  Processor  `yaml:"processor,omitempty"`
@@ -112,6 +288,8 @@ func (cfg *Config) String() string {
 	// Sanitize output, i.e. remove sensitive information.
 	tempCfg.Salesforce.Password = "**********"
 	tempCfg.Salesforce.SecurityToken = "**********"
+	tempCfg.Salesforce.ClientSecret = "**********"
+	tempCfg.Salesforce.PrivateKey = "**********"
 	tempCfg.FilesCom.Key = "**********"
 	result, err := yaml.Marshal(tempCfg)
 	if err != nil {
@@ -92,6 +92,14 @@ func TestNewSalesforce(t *testing.T) {
 	if salesforce.EnableChatter {
 		t.Errorf("Expected EnableChatter to be false, got true")
 	}
+
+	if salesforce.AuthFlow != "password" {
+		t.Errorf("Expected AuthFlow to be 'password', got '%s'", salesforce.AuthFlow)
+	}
+
+	if salesforce.CaseCacheTTL != "15m" {
+		t.Errorf("Expected CaseCacheTTL to be '15m', got '%s'", salesforce.CaseCacheTTL)
+	}
 }
 
 func TestNewConfigFromFile(t *testing.T) {
@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"regexp"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,41 +20,85 @@ import (
 )
 
 type Monitor struct {
+	CaseCache               *common.CaseCache              // Cache of cases looked up in Salesforce
+	caseNumberExtractor     *common.CaseNumberExtractor    // How to find the case number of a file
 	Config                  *config.Config                 // Configuration instance
 	Db                      *gorm.DB                       // Database connection
 	FilesComClientFactory   common.FilesComClientFactory   // How to create a new Files.com client
+	Hostname                string                         // The hostname the monitor runs on
 	mu                      *sync.Mutex                    // A mutex
 	Provider                pubsub.Provider                // Messaging provider
+	rules                   []ProcessorRule                // Compiled processor-map rules
+	exclusions              []ProcessorRule                // Compiled exclusion rules
 	SalesforceClientFactory common.SalesforceClientFactory // How to create a new Salesforce client
+	sidecars                map[string]db.File             // Sidecar files of the latest listing
+	sidecarReads            map[string]sidecarRead         // Sidecar files read, by path
 }
 
-func (m *Monitor) GetMatchingProcessors(filename string, c *common.Case) ([]string, error) {
-	var processors []string
-	for _, processor := range m.Config.Monitor.ProcessorMap {
-		switch processor.Type {
-		case "filename":
-			{
-				if ok, _ := regexp.Match(processor.Regex, []byte(filename)); ok {
-					processors = append(processors, processor.Processor)
-				}
-			}
-		case "case":
-			{
-				if c == nil {
-					continue
-				}
-				if ok, _ := regexp.Match(processor.Regex, []byte(c.CaseNumber)); ok {
-					processors = append(processors, processor.Processor)
-				}
-			}
-		default:
-			fmt.Printf("No handler found for type=%s", processor.Type)
+// sidecarRetryDelay is how long a sidecar file which failed to download is
+// not downloaded again.
+const sidecarRetryDelay = 15 * time.Minute
+
+// sidecarRead is the result of downloading a sidecar file.
+type sidecarRead struct {
+	file db.File // The sidecar file as listed when it was downloaded
+	time time.Time
+	data []byte
+	err  error
+}
+
+// Dispatch is a file matched to a processor together with the message that
+// will be published for it.
+type Dispatch struct {
+	File    db.File
+	Message *common.DispatchMessage
+}
+
+func (m *Monitor) GetMatchingProcessors(file *db.File, c *common.Case) ([]config.ProcessorMapRule, error) {
+	var rules []config.ProcessorMapRule
+	for _, rule := range m.rules {
+		if rule.Matcher.Match(file, c) {
+			rules = append(rules, rule.ProcessorMapRule)
 		}
 	}
-	if len(processors) <= 0 {
-		return nil, fmt.Errorf("no processor found for file=%s", filename)
+	if len(rules) <= 0 {
+		return nil, fmt.Errorf("no processor found for file=%s", file.Path)
 	}
-	return processors, nil
+	return rules, nil
+}
+
+// mergeReports returns the union of two report selections, where an empty
+// selection means all reports.
+func mergeReports(a, b []string) []string {
+	if len(a) == 0 || len(b) == 0 {
+		return nil
+	}
+	result := append([]string{}, a...)
+	for _, report := range b {
+		if !slices.Contains(result, report) {
+			result = append(result, report)
+		}
+	}
+	return result
+}
+
+// GetExclusion returns the reason why the file must not be sent to the given
+// processor, or an empty string if it is not excluded. Files whose case is
+// unknown, e.g. because the lookup failed, are held back while an exclusion
+// rule needs the case; they are checked again on the next poll.
+func (m *Monitor) GetExclusion(file *db.File, c *common.Case, processor string) string {
+	for _, rule := range m.exclusions {
+		if rule.Processor != "" && rule.Processor != processor {
+			continue
+		}
+		if rule.NeedsCase && c == nil {
+			return fmt.Sprintf("case unknown, held back for rule %s", rule.Describe())
+		}
+		if rule.Matcher.Match(file, c) {
+			return fmt.Sprintf("excluded by rule %s", rule.Describe())
+		}
+	}
+	return ""
 }
 
 func (m *Monitor) GetLatestFiles(dirs []string, duration time.Duration) ([]db.File, error) {
@@ -66,53 +112,166 @@ func (m *Monitor) GetLatestFiles(dirs []string, duration time.Duration) ([]db.Fi
 		return nil, err
 	}
 
+	// Sidecar files only describe the files next to them and are not
+	// processed themselves.
+	m.updateSidecars(files)
+	files = slices.DeleteFunc(files, m.isSidecar)
 	for _, file := range files {
 		m.Db.Where(db.File{Path: file.Path}).FirstOrCreate(&file)
 	}
 
 	m.Db.Where("created > ?", time.Now().Add(-duration)).Find(&files)
-	return files, nil
+	return slices.DeleteFunc(files, m.isSidecar), nil
+}
+
+func (m *Monitor) isSidecar(file db.File) bool {
+	return m.caseNumberExtractor.IsSidecar(file.Path)
+}
+
+// updateSidecars records the sidecar files of the listing and forgets the
+// sidecar files read which are gone.
+func (m *Monitor) updateSidecars(files []db.File) {
+	m.sidecars = make(map[string]db.File)
+	for _, file := range files {
+		if m.isSidecar(file) {
+			m.sidecars[file.Path] = file
+		}
+	}
+	for filePath := range m.sidecarReads {
+		if _, ok := m.sidecars[filePath]; !ok {
+			delete(m.sidecarReads, filePath)
+		}
+	}
+}
+
+// GetCaseNumber returns the case number of the file. The case number and the
+// strategy which found it are stored with the file so that the extraction is
+// only done once.
+func (m *Monitor) GetCaseNumber(file *db.File) (string, error) {
+	if file.CaseNumber != "" {
+		return file.CaseNumber, nil
+	}
+	caseNumber, strategy, err := m.caseNumberExtractor.Extract(file.Path)
+	if err != nil {
+		return "", err
+	}
+	log.Debugf("Found case number %s for '%s' using strategy '%s'", caseNumber, file.Path, strategy)
+	file.CaseNumber = caseNumber
+	file.CaseNumberStrategy = strategy
+	if file.ID != 0 {
+		m.Db.Model(file).Updates(db.File{CaseNumber: caseNumber, CaseNumberStrategy: strategy})
+	}
+	return caseNumber, nil
+}
+
+// readSidecar returns the contents of a sidecar file of the latest listing.
+// Sidecar files are only downloaded again once they changed, or a while after
+// the download failed, instead of on every poll.
+func (m *Monitor) readSidecar(filePath string) ([]byte, error) {
+	file, ok := m.sidecars[filePath]
+	if !ok {
+		return nil, fmt.Errorf("sidecar file '%s' not found", filePath)
+	}
+	if read, ok := m.sidecarReads[filePath]; ok && read.file.Size == file.Size && read.file.Checksum == file.Checksum &&
+		(read.err == nil || time.Since(read.time) < sidecarRetryDelay) {
+		return read.data, read.err
+	}
+	data, err := m.downloadSidecar(filePath)
+	if err != nil {
+		log.Warningf("Failed to download sidecar file '%s': %s", filePath, err)
+	}
+	m.sidecarReads[filePath] = sidecarRead{file: file, time: time.Now(), data: data, err: err}
+	return data, err
+}
+
+// downloadSidecar downloads a sidecar metadata file and returns its contents.
+func (m *Monitor) downloadSidecar(filePath string) ([]byte, error) {
+	filesClient, err := m.FilesComClientFactory.NewFilesComClient(m.Config.FilesCom.Key, m.Config.FilesCom.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(m.Config.Monitor.BaseTmpDir, "athena-sidecar-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if _, err := filesClient.Download(&db.File{Path: filePath}, dir); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(dir, filepath.Base(filePath)))
 }
 
-func (m *Monitor) GetMatchingProcessorByFile(files []db.File) (map[string][]db.File, error) {
-	var sfCase = &common.Case{}
-	var results = make(map[string][]db.File)
+func (m *Monitor) GetMatchingProcessorByFile(files []db.File) (map[string][]Dispatch, error) {
+	var results = make(map[string][]Dispatch)
 
 	salesforceClient, err := m.SalesforceClientFactory.NewSalesforceClient(m.Config)
 	if err != nil {
 		panic(err)
 	}
 
-	for _, file := range files {
-		var processors []string
-
-		log.Debugf("Analyzing file %s", file.Path)
-		caseNumber, err := common.GetCaseNumberFromFilename(file.Path)
-		if err == nil {
-			sfCase, err = salesforceClient.GetCaseByNumber(caseNumber)
-			if err != nil {
-				log.Warningf("Failed to get a case from number: '%s'", caseNumber)
-			} else {
-				log.Debugf("Found customer '%s' for case number %s", sfCase.Customer, caseNumber)
-			}
-		} else {
-			log.Warningf("Failed to identify case from filename '%s': %s", file.Path, err)
+	var caseNumbers []string
+	for i := range files {
+		log.Debugf("Analyzing file %s", files[i].Path)
+		caseNumber, err := m.GetCaseNumber(&files[i])
+		if err != nil {
+			log.Warningf("Failed to identify case of '%s': %s", files[i].Path, err)
+			continue
 		}
+		caseNumbers = append(caseNumbers, caseNumber)
+	}
 
-		if sfCase != nil {
-			processors, err = m.GetMatchingProcessors(file.Path, sfCase)
-		} else {
-			processors, err = m.GetMatchingProcessors(file.Path, nil)
-		}
+	cases, err := m.CaseCache.GetCases(salesforceClient, caseNumbers)
+	if err != nil {
+		log.Warningf("Failed to look up cases: %s", err)
+	}
 
-		for _, processor := range processors {
-			results[processor] = append(results[processor], file)
+	for _, file := range files {
+		caseNumber := file.CaseNumber
+		sfCase, ok := cases[caseNumber]
+		if ok {
+			log.Debugf("Found customer '%s' for case number %s", sfCase.Customer, caseNumber)
+		} else if caseNumber != "" {
+			log.Warningf("Failed to get a case from number: '%s'", caseNumber)
 		}
 
+		rules, err := m.GetMatchingProcessors(&file, sfCase)
 		if err != nil {
 			log.Errorf("Failed to identify processor(s) for '%s' (case=%s): %s", file.Path, caseNumber, err)
 			continue
 		}
+
+		var skipReasons []string
+		var messages = make(map[string]*common.DispatchMessage)
+		for _, rule := range rules {
+			if reason := m.GetExclusion(&file, sfCase, rule.Processor); reason != "" {
+				log.Infof("Not sending '%s' to processor %s: %s", file.Path, rule.Processor, reason)
+				skipReasons = append(skipReasons, fmt.Sprintf("%s: %s", rule.Processor, reason))
+				continue
+			}
+			// Several rules may send the file to the same processor, in
+			// which case it is only sent once.
+			if message, ok := messages[rule.Processor]; ok {
+				message.Reports = mergeReports(message.Reports, rule.Reports)
+				message.Rule += "; " + rule.String()
+				continue
+			}
+			message := common.NewDispatchMessage(&file)
+			message.CaseNumber = caseNumber
+			message.Monitor = m.Hostname
+			message.Reports = rule.Reports
+			message.Rule = rule.String()
+			messages[rule.Processor] = message
+			if sfCase != nil {
+				message.Customer = sfCase.Customer
+			}
+			results[rule.Processor] = append(results[rule.Processor], Dispatch{File: file, Message: message})
+		}
+
+		skipReason := strings.Join(skipReasons, "; ")
+		if skipReason != file.SkipReason {
+			file.SkipReason = skipReason
+			m.Db.Model(&file).Update("skip_reason", skipReason)
+		}
 	}
 
 	return results, nil
@@ -121,7 +280,16 @@ func (m *Monitor) GetMatchingProcessorByFile(files []db.File) (map[string][]db.F
 func NewMonitor(provider pubsub.Provider, cfg *config.Config, dbConn *gorm.DB,
 	salesforceClientFactory common.SalesforceClientFactory,
 	filesComClientFactory common.FilesComClientFactory) (*Monitor, error) {
-	var err error
+	rules, err := NewProcessorRules(&cfg.Monitor)
+	if err != nil {
+		return nil, err
+	}
+
+	exclusions, err := NewExclusionRules(&cfg.Monitor)
+	if err != nil {
+		return nil, err
+	}
+
 	if dbConn == nil {
 		dbConn, err = db.GetDBConn(cfg)
 		if err != nil {
@@ -129,14 +297,36 @@ func NewMonitor(provider pubsub.Provider, cfg *config.Config, dbConn *gorm.DB,
 		}
 	}
 
-	return &Monitor{
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	caseCache, err := common.NewCaseCacheFromConfig(cfg, dbConn)
+	if err != nil {
+		return nil, err
+	}
+
+	monitor := &Monitor{
+		CaseCache:               caseCache,
 		Config:                  cfg,
 		Db:                      dbConn,
 		FilesComClientFactory:   filesComClientFactory,
+		Hostname:                hostname,
 		mu:                      new(sync.Mutex),
 		Provider:                provider,
+		exclusions:              exclusions,
+		rules:                   rules,
 		SalesforceClientFactory: salesforceClientFactory,
-	}, nil
+		sidecarReads:            make(map[string]sidecarRead),
+	}
+
+	monitor.caseNumberExtractor, err = common.NewCaseNumberExtractor(&cfg.CaseNumber, monitor.readSidecar)
+	if err != nil {
+		return nil, err
+	}
+
+	return monitor, nil
 }
 
 func (m *Monitor) PollNewFiles(ctx *context.Context, duration time.Duration) {
@@ -164,8 +354,9 @@ func (m *Monitor) PollNewFiles(ctx *context.Context, duration time.Duration) {
 	}
 
 	log.Infof("Found %d new files, %d to be processed", len(latestFiles), len(processors))
-	for processor, files := range processors {
-		for _, file := range files {
+	for processor, dispatches := range processors {
+		for _, dispatch := range dispatches {
+			file := dispatch.File
 			if file.Dispatched {
 				log.Infof("File %s already dispatched, skipping", file.Path)
 				continue
@@ -190,11 +381,11 @@ func (m *Monitor) PollNewFiles(ctx *context.Context, duration time.Duration) {
 			}
 			log.Infof("Downloaded %s", fileEntry.Path)
 
-			log.Infof("Sending file: %s to processor: %s", file.Path, processor)
-			publishResults := pubsub.PublishJSON(*ctx, processor, file)
+			log.Infof("Sending file: %s to processor: %s (correlation-id=%s)", file.Path, processor, dispatch.Message.CorrelationID)
+			publishResults := pubsub.PublishJSON(*ctx, processor, dispatch.Message)
 			if publishResults.Err != nil {
 				file.Dispatched = false
-				log.Errorf("Cannot dispatch file: %s to processor, error: %s", file.Path, err)
+				log.Errorf("Cannot dispatch file: %s to processor, error: %s", file.Path, publishResults.Err)
 			} else {
 				file.Dispatched = true
 				log.Debugf("File: %s -- flagged as dispatched", file.Path)
@@ -2,6 +2,9 @@ package monitor
 
 import (
 	"context"
+	"fmt"
+	files_sdk "github.com/Files-com/files-sdk-go"
+	"github.com/canonical/athena-core/pkg/common"
 	"github.com/canonical/athena-core/pkg/common/db"
 	"github.com/canonical/athena-core/pkg/common/test"
 	"github.com/canonical/athena-core/pkg/config"
@@ -12,6 +15,8 @@ import (
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"io"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -30,7 +35,7 @@ func (s *MonitorTestSuite) SetupTest() {
 	s.config, _ = config.NewConfigFromBytes([]byte(test.DefaultTestConfig))
 	assert.Equal(s.T(), "sqlite", s.config.Db.Dialect)
 	s.db, _ = gorm.Open(sqlite.Open("file::memory:?cache=shared"))
-	s.db.AutoMigrate(db.File{}, db.Report{})
+	s.db.AutoMigrate(db.File{}, db.Report{}, db.Case{})
 }
 
 func (s *MonitorTestSuite) TestRunMonitor() {
@@ -46,3 +51,137 @@ func (s *MonitorTestSuite) TestRunMonitor() {
 func TestMonitor(t *testing.T) {
 	suite.Run(t, &MonitorTestSuite{})
 }
+
+func TestMergeReports(t *testing.T) {
+	assert.Nil(t, mergeReports(nil, []string{"hotsos"}))
+	assert.Nil(t, mergeReports([]string{"hotsos"}, nil))
+	assert.Equal(t, []string{"hotsos", "crashdump"}, mergeReports([]string{"hotsos"}, []string{"crashdump", "hotsos"}))
+}
+
+type failingSalesforceClient struct {
+	test.SalesforceClient
+}
+
+func (sf *failingSalesforceClient) GetCasesByNumbers(numbers []string) (map[string]*common.Case, error) {
+	return nil, fmt.Errorf("REQUEST_LIMIT_EXCEEDED")
+}
+
+type failingSalesforceClientFactory struct{}
+
+func (sf *failingSalesforceClientFactory) NewSalesforceClient(config *config.Config) (common.SalesforceClient, error) {
+	return &failingSalesforceClient{}, nil
+}
+
+func TestExclusionUnknownCase(t *testing.T) {
+	cfg, err := config.NewConfigFromBytes([]byte(test.DefaultTestConfig))
+	assert.Nil(t, err)
+	cfg.Monitor.Exclude = []config.ProcessorMapRule{{Type: "customer", Regex: "ACME"}}
+	dbConn, err := gorm.Open(sqlite.Open("file::memory:"))
+	assert.Nil(t, err)
+	assert.Nil(t, dbConn.AutoMigrate(db.File{}, db.Report{}, db.Case{}))
+	file := db.File{Path: "/uploads/sosreport-123456.tar.xz", Created: time.Now()}
+	assert.Nil(t, dbConn.Create(&file).Error)
+
+	// The customer of the case cannot be checked, the file is held back.
+	monitor, err := NewMonitor(&memory.MemoryProvider{}, cfg, dbConn, &failingSalesforceClientFactory{}, &test.FilesComClientFactory{})
+	assert.Nil(t, err)
+	dispatches, err := monitor.GetMatchingProcessorByFile([]db.File{file})
+	assert.Nil(t, err)
+	assert.Empty(t, dispatches)
+	assert.Nil(t, dbConn.First(&file).Error)
+	assert.Contains(t, file.SkipReason, "case unknown")
+
+	// Exclusions which do not need the case still let it through.
+	cfg.Monitor.Exclude = []config.ProcessorMapRule{{Type: "filename", Regex: "crashdump"}}
+	monitor, err = NewMonitor(&memory.MemoryProvider{}, cfg, dbConn, &failingSalesforceClientFactory{}, &test.FilesComClientFactory{})
+	assert.Nil(t, err)
+	dispatches, err = monitor.GetMatchingProcessorByFile([]db.File{file})
+	assert.Nil(t, err)
+	assert.Len(t, dispatches["sosreports"], 1)
+	assert.Nil(t, dbConn.First(&file).Error)
+	assert.Empty(t, file.SkipReason)
+}
+
+// sidecarFilesComClient lists sosreports with sidecar files and counts the
+// downloads of the sidecar files.
+type sidecarFilesComClient struct {
+	test.FilesComClient
+	files     []db.File
+	sidecars  map[string]string // Contents of the sidecar files, missing ones fail to download
+	downloads map[string]int
+}
+
+func (fc *sidecarFilesComClient) GetFiles(dirs []string) ([]db.File, error) {
+	return append([]db.File{}, fc.files...), nil
+}
+
+func (fc *sidecarFilesComClient) Download(toDownload *db.File, downloadPath string) (*files_sdk.File, error) {
+	fc.downloads[toDownload.Path]++
+	contents, ok := fc.sidecars[toDownload.Path]
+	if !ok {
+		return nil, fmt.Errorf("download of '%s' failed", toDownload.Path)
+	}
+	return &files_sdk.File{Path: toDownload.Path}, os.WriteFile(filepath.Join(downloadPath, filepath.Base(toDownload.Path)), []byte(contents), 0600)
+}
+
+type sidecarFilesComClientFactory struct {
+	client *sidecarFilesComClient
+}
+
+func (fc *sidecarFilesComClientFactory) NewFilesComClient(apiKey, endpoint string) (common.FilesComClient, error) {
+	return fc.client, nil
+}
+
+func TestSidecarFiles(t *testing.T) {
+	cfg, err := config.NewConfigFromBytes([]byte(test.DefaultTestConfig))
+	assert.Nil(t, err)
+	cfg.CaseNumber.Strategies = []config.CaseNumberStrategy{{Type: "sidecar"}}
+	cfg.Monitor.BaseTmpDir = t.TempDir()
+	dbConn, err := gorm.Open(sqlite.Open("file::memory:"))
+	assert.Nil(t, err)
+	assert.Nil(t, dbConn.AutoMigrate(db.File{}, db.Report{}, db.Case{}))
+
+	client := &sidecarFilesComClient{
+		files: []db.File{
+			{Path: "/uploads/sosreport-a.tar.xz", Created: time.Now()},
+			{Path: "/uploads/sosreport-a.tar.xz.athena.yaml", Created: time.Now(), Checksum: "md5:a"},
+			{Path: "/uploads/sosreport-b.tar.xz", Created: time.Now()},
+			{Path: "/uploads/sosreport-b.tar.xz.athena.yaml", Created: time.Now(), Checksum: "md5:b"},
+			{Path: "/uploads/sosreport-c.tar.xz", Created: time.Now()},
+		},
+		sidecars:  map[string]string{"/uploads/sosreport-a.tar.xz.athena.yaml": "case-number: 123456\n"},
+		downloads: make(map[string]int),
+	}
+	monitor, err := NewMonitor(&memory.MemoryProvider{}, cfg, dbConn, &test.SalesforceClientFactory{}, &sidecarFilesComClientFactory{client: client})
+	assert.Nil(t, err)
+
+	// The sidecar files are not processed themselves.
+	for i := 0; i < 2; i++ {
+		files, err := monitor.GetLatestFiles(cfg.Monitor.Directories, time.Hour)
+		assert.Nil(t, err)
+		var paths []string
+		for _, file := range files {
+			paths = append(paths, file.Path)
+		}
+		assert.ElementsMatch(t, []string{"/uploads/sosreport-a.tar.xz", "/uploads/sosreport-b.tar.xz", "/uploads/sosreport-c.tar.xz"}, paths)
+		_, err = monitor.GetMatchingProcessorByFile(files)
+		assert.Nil(t, err)
+	}
+	var count int64
+	dbConn.Model(&db.File{}).Where("path LIKE ?", "%.athena.yaml").Count(&count)
+	assert.Zero(t, count)
+
+	// Every sidecar file is downloaded once, files without one never.
+	var file db.File
+	assert.Nil(t, dbConn.Where("path = ?", "/uploads/sosreport-a.tar.xz").First(&file).Error)
+	assert.Equal(t, "123456", file.CaseNumber)
+	assert.Equal(t, map[string]int{"/uploads/sosreport-a.tar.xz.athena.yaml": 1, "/uploads/sosreport-b.tar.xz.athena.yaml": 1}, client.downloads)
+
+	// A sidecar file which changed is downloaded again.
+	client.files[3].Checksum = "md5:c"
+	files, err := monitor.GetLatestFiles(cfg.Monitor.Directories, time.Hour)
+	assert.Nil(t, err)
+	_, err = monitor.GetMatchingProcessorByFile(files)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, client.downloads["/uploads/sosreport-b.tar.xz.athena.yaml"])
+}
@@ -0,0 +1,256 @@
+package monitor
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/canonical/athena-core/pkg/common"
+	"github.com/canonical/athena-core/pkg/common/db"
+	"github.com/canonical/athena-core/pkg/config"
+)
+
+// Matcher decides whether a file (and the case it belongs to, if any) is
+// matched by a processor-map rule.
+type Matcher interface {
+	Match(file *db.File, c *common.Case) bool
+}
+
+type regexMatcher struct {
+	regex *regexp.Regexp
+	value func(file *db.File, c *common.Case) (string, bool)
+}
+
+func (m *regexMatcher) Match(file *db.File, c *common.Case) bool {
+	value, ok := m.value(file, c)
+	if !ok {
+		return false
+	}
+	return m.regex.MatchString(value)
+}
+
+type sizeMatcher struct {
+	min, max int64
+}
+
+func (m *sizeMatcher) Match(file *db.File, _ *common.Case) bool {
+	if m.min > 0 && file.Size < m.min {
+		return false
+	}
+	if m.max > 0 && file.Size > m.max {
+		return false
+	}
+	return true
+}
+
+type extensionMatcher struct {
+	extensions []string
+}
+
+func (m *extensionMatcher) Match(file *db.File, _ *common.Case) bool {
+	name := strings.ToLower(filepath.Base(file.Path))
+	for _, extension := range m.extensions {
+		if strings.HasSuffix(name, strings.ToLower(extension)) {
+			return true
+		}
+	}
+	return false
+}
+
+type allMatcher []Matcher
+
+func (m allMatcher) Match(file *db.File, c *common.Case) bool {
+	for _, matcher := range m {
+		if !matcher.Match(file, c) {
+			return false
+		}
+	}
+	return true
+}
+
+type anyMatcher []Matcher
+
+func (m anyMatcher) Match(file *db.File, c *common.Case) bool {
+	for _, matcher := range m {
+		if matcher.Match(file, c) {
+			return true
+		}
+	}
+	return false
+}
+
+type notMatcher struct {
+	matcher Matcher
+}
+
+func (m *notMatcher) Match(file *db.File, c *common.Case) bool {
+	return !m.matcher.Match(file, c)
+}
+
+// NewMatcher compiles a processor-map rule. The filetypes are used by
+// extension rules which do not list their own extensions.
+func NewMatcher(rule config.ProcessorMapRule, filetypes []string) (Matcher, error) {
+	compileRegex := func() (*regexp.Regexp, error) {
+		if rule.Regex == "" {
+			return nil, fmt.Errorf("rule type '%s' requires a regex", rule.Type)
+		}
+		regex, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex '%s': %s", rule.Regex, err)
+		}
+		return regex, nil
+	}
+
+	switch rule.Type {
+	case "filename":
+		regex, err := compileRegex()
+		if err != nil {
+			return nil, err
+		}
+		return &regexMatcher{regex: regex, value: func(file *db.File, _ *common.Case) (string, bool) {
+			return file.Path, true
+		}}, nil
+	case "case":
+		regex, err := compileRegex()
+		if err != nil {
+			return nil, err
+		}
+		return &regexMatcher{regex: regex, value: func(_ *db.File, c *common.Case) (string, bool) {
+			if c == nil {
+				return "", false
+			}
+			return c.CaseNumber, true
+		}}, nil
+	case "customer":
+		regex, err := compileRegex()
+		if err != nil {
+			return nil, err
+		}
+		return &regexMatcher{regex: regex, value: func(_ *db.File, c *common.Case) (string, bool) {
+			if c == nil {
+				return "", false
+			}
+			return c.Customer, true
+		}}, nil
+	case "case-field":
+		if rule.Field == "" {
+			return nil, fmt.Errorf("rule type '%s' requires a field", rule.Type)
+		}
+		regex, err := compileRegex()
+		if err != nil {
+			return nil, err
+		}
+		field := rule.Field
+		return &regexMatcher{regex: regex, value: func(_ *db.File, c *common.Case) (string, bool) {
+			if c == nil || c.Fields == nil {
+				return "", false
+			}
+			value, ok := c.Fields[field]
+			return value, ok
+		}}, nil
+	case "size":
+		min, err := common.ParseSize(rule.MinSize)
+		if err != nil {
+			return nil, err
+		}
+		max, err := common.ParseSize(rule.MaxSize)
+		if err != nil {
+			return nil, err
+		}
+		if min == 0 && max == 0 {
+			return nil, fmt.Errorf("rule type '%s' requires min-size and/or max-size", rule.Type)
+		}
+		if max > 0 && min > max {
+			return nil, fmt.Errorf("min-size %s is larger than max-size %s", rule.MinSize, rule.MaxSize)
+		}
+		return &sizeMatcher{min: min, max: max}, nil
+	case "extension":
+		extensions := rule.Extensions
+		if len(extensions) == 0 {
+			extensions = filetypes
+		}
+		if len(extensions) == 0 {
+			return nil, fmt.Errorf("rule type '%s' requires extensions or monitor.filetypes", rule.Type)
+		}
+		return &extensionMatcher{extensions: extensions}, nil
+	case "all", "any", "not":
+		if len(rule.Rules) == 0 {
+			return nil, fmt.Errorf("rule type '%s' requires nested rules", rule.Type)
+		}
+		if rule.Type == "not" && len(rule.Rules) != 1 {
+			return nil, fmt.Errorf("rule type 'not' takes exactly one nested rule, got %d", len(rule.Rules))
+		}
+		var matchers []Matcher
+		for _, nested := range rule.Rules {
+			if nested.Processor != "" {
+				return nil, fmt.Errorf("nested rule '%s' must not set a processor", nested.Describe())
+			}
+			matcher, err := NewMatcher(nested, filetypes)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, matcher)
+		}
+		switch rule.Type {
+		case "all":
+			return allMatcher(matchers), nil
+		case "any":
+			return anyMatcher(matchers), nil
+		default:
+			return &notMatcher{matcher: matchers[0]}, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown rule type '%s'", rule.Type)
+	}
+}
+
+// ProcessorRule is a compiled processor-map rule.
+type ProcessorRule struct {
+	config.ProcessorMapRule
+	Matcher   Matcher
+	NeedsCase bool // Whether the rule can only be checked with the case
+}
+
+// needsCase returns whether the rule, or one of its nested rules, matches on
+// data of the case.
+func needsCase(rule config.ProcessorMapRule) bool {
+	switch rule.Type {
+	case "case", "customer", "case-field":
+		return true
+	}
+	return slices.ContainsFunc(rule.Rules, needsCase)
+}
+
+// NewProcessorRules compiles and validates all processor-map rules of the
+// monitor configuration.
+func NewProcessorRules(cfg *config.Monitor) ([]ProcessorRule, error) {
+	var rules []ProcessorRule
+	for i, rule := range cfg.ProcessorMap {
+		if rule.Processor == "" {
+			return nil, fmt.Errorf("processor-map[%d]: no processor given", i)
+		}
+		matcher, err := NewMatcher(rule, cfg.Filetypes)
+		if err != nil {
+			return nil, fmt.Errorf("processor-map[%d]: %s", i, err)
+		}
+		rules = append(rules, ProcessorRule{ProcessorMapRule: rule, Matcher: matcher})
+	}
+	return rules, nil
+}
+
+// NewExclusionRules compiles and validates the exclusion rules of the monitor
+// configuration. An exclusion rule without a processor applies to all
+// processors.
+func NewExclusionRules(cfg *config.Monitor) ([]ProcessorRule, error) {
+	var rules []ProcessorRule
+	for i, rule := range cfg.Exclude {
+		matcher, err := NewMatcher(rule, cfg.Filetypes)
+		if err != nil {
+			return nil, fmt.Errorf("exclude[%d]: %s", i, err)
+		}
+		rules = append(rules, ProcessorRule{ProcessorMapRule: rule, Matcher: matcher, NeedsCase: needsCase(rule)})
+	}
+	return rules, nil
+}
@@ -0,0 +1,105 @@
+package monitor
+
+import (
+	"testing"
+
+	"github.com/canonical/athena-core/pkg/common"
+	"github.com/canonical/athena-core/pkg/common/db"
+	"github.com/canonical/athena-core/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatcher(t *testing.T) {
+	sosreport := &db.File{Path: "/uploads/sosreport-123456.tar.xz", Size: 50 << 20}
+	crashdump := &db.File{Path: "/uploads/juju-crashdump-123456.tar.gz", Size: 5 << 20}
+	sfCase := &common.Case{CaseNumber: "123456", Customer: "ACME", Fields: map[string]string{"Status": "New"}}
+
+	tests := []struct {
+		rule     config.ProcessorMapRule
+		file     *db.File
+		sfCase   *common.Case
+		expected bool
+	}{
+		{config.ProcessorMapRule{Type: "filename", Regex: "sosreport"}, sosreport, nil, true},
+		{config.ProcessorMapRule{Type: "filename", Regex: "sosreport"}, crashdump, nil, false},
+		{config.ProcessorMapRule{Type: "case", Regex: "^123"}, sosreport, sfCase, true},
+		{config.ProcessorMapRule{Type: "case", Regex: "^123"}, sosreport, nil, false},
+		{config.ProcessorMapRule{Type: "customer", Regex: "(?i)acme"}, sosreport, sfCase, true},
+		{config.ProcessorMapRule{Type: "case-field", Field: "Status", Regex: "New"}, sosreport, sfCase, true},
+		{config.ProcessorMapRule{Type: "case-field", Field: "Product", Regex: ".*"}, sosreport, sfCase, false},
+		{config.ProcessorMapRule{Type: "size", MinSize: "10M"}, sosreport, nil, true},
+		{config.ProcessorMapRule{Type: "size", MinSize: "10M"}, crashdump, nil, false},
+		{config.ProcessorMapRule{Type: "size", MaxSize: "10M"}, crashdump, nil, true},
+		{config.ProcessorMapRule{Type: "extension", Extensions: []string{".tar.gz"}}, crashdump, nil, true},
+		{config.ProcessorMapRule{Type: "extension", Extensions: []string{".tar.gz"}}, sosreport, nil, false},
+		{config.ProcessorMapRule{Type: "all", Rules: []config.ProcessorMapRule{
+			{Type: "filename", Regex: "sosreport"},
+			{Type: "customer", Regex: "ACME"},
+		}}, sosreport, sfCase, true},
+		{config.ProcessorMapRule{Type: "all", Rules: []config.ProcessorMapRule{
+			{Type: "filename", Regex: "sosreport"},
+			{Type: "customer", Regex: "ACME"},
+		}}, sosreport, nil, false},
+		{config.ProcessorMapRule{Type: "any", Rules: []config.ProcessorMapRule{
+			{Type: "filename", Regex: "sosreport"},
+			{Type: "filename", Regex: "crashdump"},
+		}}, crashdump, nil, true},
+		{config.ProcessorMapRule{Type: "not", Rules: []config.ProcessorMapRule{
+			{Type: "filename", Regex: "sosreport"},
+		}}, crashdump, nil, true},
+	}
+
+	for _, test := range tests {
+		matcher, err := NewMatcher(test.rule, nil)
+		assert.Nil(t, err, test.rule.Describe())
+		assert.Equal(t, test.expected, matcher.Match(test.file, test.sfCase), test.rule.Describe())
+	}
+}
+
+func TestMatcherFiletypes(t *testing.T) {
+	matcher, err := NewMatcher(config.ProcessorMapRule{Type: "extension"}, []string{".tar.xz"})
+	assert.Nil(t, err)
+	assert.True(t, matcher.Match(&db.File{Path: "/uploads/sosreport-123456.tar.xz"}, nil))
+	assert.False(t, matcher.Match(&db.File{Path: "/uploads/sosreport-123456.zip"}, nil))
+}
+
+func TestNewProcessorRulesInvalid(t *testing.T) {
+	for _, rule := range []config.ProcessorMapRule{
+		{Type: "unknown", Regex: ".*", Processor: "sosreports"},
+		{Type: "filename", Regex: "(", Processor: "sosreports"},
+		{Type: "filename", Regex: ".*"},
+		{Type: "case-field", Regex: ".*", Processor: "sosreports"},
+		{Type: "size", MinSize: "2M", MaxSize: "1M", Processor: "sosreports"},
+		{Type: "extension", Processor: "sosreports"},
+		{Type: "not", Processor: "sosreports", Rules: []config.ProcessorMapRule{
+			{Type: "filename", Regex: "a"}, {Type: "filename", Regex: "b"},
+		}},
+		{Type: "any", Processor: "sosreports", Rules: []config.ProcessorMapRule{
+			{Type: "filename", Regex: "a", Processor: "other"},
+		}},
+	} {
+		_, err := NewProcessorRules(&config.Monitor{ProcessorMap: []config.ProcessorMapRule{rule}})
+		assert.NotNil(t, err, rule.Describe())
+	}
+}
+
+func TestGetExclusion(t *testing.T) {
+	exclusions, err := NewExclusionRules(&config.Monitor{Exclude: []config.ProcessorMapRule{
+		{Type: "customer", Regex: "^ACME$"},
+		{Type: "filename", Regex: "crashdump", Processor: "sosreports"},
+	}})
+	assert.Nil(t, err)
+	monitor := &Monitor{exclusions: exclusions}
+
+	sosreport := &db.File{Path: "/uploads/sosreport-123456.tar.xz"}
+	crashdump := &db.File{Path: "/uploads/juju-crashdump-123456.tar.gz"}
+	acme := &common.Case{CaseNumber: "123456", Customer: "ACME"}
+	other := &common.Case{CaseNumber: "123456", Customer: "Initech"}
+
+	assert.NotEmpty(t, monitor.GetExclusion(sosreport, acme, "sosreports"))
+	assert.Empty(t, monitor.GetExclusion(sosreport, other, "sosreports"))
+	// Without the case the customer cannot be checked.
+	assert.Contains(t, monitor.GetExclusion(sosreport, nil, "sosreports"), "case unknown")
+	assert.NotEmpty(t, monitor.GetExclusion(crashdump, other, "sosreports"))
+	assert.Empty(t, monitor.GetExclusion(crashdump, other, "crashdumps"))
+}
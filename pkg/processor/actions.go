@@ -0,0 +1,170 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/canonical/athena-core/pkg/common"
+	"github.com/canonical/athena-core/pkg/common/db"
+	"github.com/canonical/athena-core/pkg/config"
+	"github.com/flosch/pongo2/v4"
+	"github.com/simpleforce/simpleforce"
+	log "github.com/sirupsen/logrus"
+)
+
+const webhookTimeout = 30 * time.Second
+
+// Action is a post-processing action of a subscriber.
+type Action struct {
+	config.Action
+	Conditions Conditions
+	templates  *Templates
+}
+
+func NewAction(cfg config.Action, templates *Templates) (*Action, error) {
+	switch cfg.Type {
+	case "comment", "status", "priority":
+	case "case-field":
+		if cfg.Field == "" {
+			return nil, fmt.Errorf("case-field action requires a field")
+		}
+	case "task":
+		if cfg.Subject == "" {
+			return nil, fmt.Errorf("task action requires a subject")
+		}
+	case "webhook":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("webhook action requires a url")
+		}
+	default:
+		return nil, fmt.Errorf("unknown action type '%s'", cfg.Type)
+	}
+	for _, tpl := range []string{cfg.Template, cfg.Subject} {
+		if err := templates.Check(tpl); err != nil {
+			return nil, fmt.Errorf("invalid %s action template: %s", cfg.Type, err)
+		}
+	}
+	conditions, err := NewConditions(cfg.When)
+	if err != nil {
+		return nil, err
+	}
+	return &Action{Action: cfg, Conditions: conditions, templates: templates}, nil
+}
+
+// NewActions compiles the actions of a subscriber.
+func NewActions(cfg []config.Action, templates *Templates) ([]*Action, error) {
+	var actions []*Action
+	for i, c := range cfg {
+		action, err := NewAction(c, templates)
+		if err != nil {
+			return nil, fmt.Errorf("action %d: %s", i+1, err)
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+// Run runs the action on the case and returns a description of the result.
+func (a *Action) Run(client common.SalesforceClient, caseId string, ctx pongo2.Context, chatter bool) (string, error) {
+	body, err := a.templates.Render(ctx, a.Template)
+	if err != nil {
+		return "", err
+	}
+
+	switch a.Type {
+	case "comment":
+		var comment *simpleforce.SObject
+		if chatter {
+			comment = client.PostChatter(caseId, body, a.Public)
+		} else {
+			comment = client.PostComment(caseId, body, a.Public)
+		}
+		if comment == nil {
+			return "", fmt.Errorf("failed to post comment")
+		}
+		return comment.ID(), nil
+	case "status":
+		return "Status", client.UpdateCase(caseId, map[string]string{"Status": body})
+	case "priority":
+		return "Priority", client.UpdateCase(caseId, map[string]string{"Priority": body})
+	case "case-field":
+		return a.Field, client.UpdateCase(caseId, map[string]string{a.Field: body})
+	case "task":
+		subject, err := a.templates.Render(ctx, a.Subject)
+		if err != nil {
+			return "", err
+		}
+		return client.CreateTask(caseId, subject, body)
+	case "webhook":
+		return a.callWebhook(body)
+	}
+	return "", fmt.Errorf("unknown action type '%s'", a.Type)
+}
+
+func (a *Action) callWebhook(body string) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, a.URL, bytes.NewReader([]byte(body)))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range a.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := (&http.Client{Timeout: webhookTimeout}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("webhook '%s' returned status %d", a.URL, resp.StatusCode)
+	}
+	return resp.Status, nil
+}
+
+// actionKey identifies the i-th action run for a batch.
+func actionKey(batch *commentBatch, i int) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s\naction %d", batch.batchKey(), i)))
+	return hex.EncodeToString(hash[:])
+}
+
+// runActions runs the actions of the subscriber whose conditions match the
+// batch, skipping actions which already ran in an earlier attempt. It returns
+// whether all actions succeeded.
+func (p *Processor) runActions(client common.SalesforceClient, batch *commentBatch, ctx pongo2.Context) bool {
+	success := true
+	for i, action := range p.Actions[batch.subscriber] {
+		if !action.Conditions.Match(batch.reports) {
+			log.Debugf("Conditions of %s action do not match case %s", action.Type, batch.caseId)
+			continue
+		}
+		key := actionKey(batch, i)
+		var count int64
+		if err := p.Db.Model(&db.ActionRun{}).Where("dedup_key = ?", key).Count(&count).Error; err != nil {
+			log.Errorf("Failed to look up %s action for case %s: %s", action.Type, batch.caseId, err)
+			success = false
+			continue
+		}
+		if count > 0 {
+			continue
+		}
+
+		result, err := action.Run(client, batch.caseId, ctx, p.Config.Salesforce.EnableChatter)
+		if err != nil {
+			log.Errorf("Failed to run %s action for case %s: %s", action.Type, batch.caseId, err)
+			success = false
+			continue
+		}
+		log.Infof("Ran %s action for case %s: %s", action.Type, batch.caseId, result)
+		run := db.ActionRun{DedupKey: key, CaseID: batch.caseId, Subscriber: batch.subscriber, Type: action.Type, Result: result}
+		if err := p.Db.Create(&run).Error; err != nil {
+			log.Errorf("Failed to record %s action for case %s: %s", action.Type, batch.caseId, err)
+		}
+	}
+	return success
+}
@@ -0,0 +1,164 @@
+package processor
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/canonical/athena-core/pkg/common"
+	"github.com/canonical/athena-core/pkg/common/db"
+	"github.com/canonical/athena-core/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// validateArtifacts checks the artifacts globs of all scripts of the reports.
+// Globs have to stay inside the working directory of the scripts.
+func validateArtifacts(reports map[string]config.Report) error {
+	for reportName, report := range reports {
+		for scriptName, script := range report.Scripts {
+			for _, pattern := range script.Artifacts {
+				if filepath.IsAbs(pattern) || slices.Contains(strings.Split(filepath.ToSlash(pattern), "/"), "..") {
+					return fmt.Errorf("script '%s.%s': artifacts '%s' must be relative to the working directory", reportName, scriptName, pattern)
+				}
+				if _, err := filepath.Match(pattern, ""); err != nil {
+					return fmt.Errorf("script '%s.%s': invalid artifacts glob '%s': %s", reportName, scriptName, pattern, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// collectArtifacts returns the regular files matching the globs, relative to
+// the working directory. Matching directories contribute all files below
+// them. Files whose real path is outside of the working directory are
+// skipped, so that a symbolic link in an archive cannot publish a file of the
+// host.
+func collectArtifacts(workDir string, patterns []string) ([]string, error) {
+	realWorkDir, err := filepath.EvalSymlinks(workDir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	add := func(name, rel string, entry fs.DirEntry) {
+		if !entry.Type().IsRegular() || slices.Contains(files, rel) {
+			return
+		}
+		real, err := filepath.EvalSymlinks(name)
+		if err == nil {
+			real, err = filepath.Rel(realWorkDir, real)
+		}
+		if err != nil || strings.HasPrefix(real, "..") {
+			log.Warnf("Skipping artifact '%s' outside of the working directory", rel)
+			return
+		}
+		files = append(files, rel)
+	}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(workDir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			log.Warnf("No artifacts match '%s'", pattern)
+		}
+		for _, match := range matches {
+			err := filepath.WalkDir(match, func(name string, entry fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				rel, err := filepath.Rel(workDir, name)
+				if err != nil {
+					return err
+				}
+				add(name, rel, entry)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// archiveArtifacts returns a tar.gz archive of the files.
+func archiveArtifacts(workDir string, files []string) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	for _, name := range files {
+		content, err := os.ReadFile(filepath.Join(workDir, name))
+		if err != nil {
+			return nil, err
+		}
+		header := &tar.Header{Name: filepath.ToSlash(name), Mode: 0644, Size: int64(len(content))}
+		if err := archive.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := archive.Write(content); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// uploadArtifacts uploads the artifacts of the script next to its output,
+// either one by one below destination.artifacts/ or as a single
+// destination.artifacts.tar.gz archive.
+func uploadArtifacts(client common.FilesComClient, report *ReportToExecute, scriptName, destination string) ([]db.Artifact, error) {
+	patterns := report.Artifacts[scriptName]
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	workDir := report.WorkDir
+	if workDir == "" {
+		workDir = report.BaseDir
+	}
+	files, err := collectArtifacts(workDir, patterns)
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+
+	var artifacts []db.Artifact
+	if report.ArchiveArtifacts[scriptName] {
+		content, err := archiveArtifacts(workDir, files)
+		if err != nil {
+			return nil, err
+		}
+		uploaded, err := client.Upload(string(content), destination+".artifacts.tar.gz")
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload artifacts of '%s': %s", scriptName, err)
+		}
+		log.Debugf("Uploaded %d artifact(s) of '%s' to %s", len(files), scriptName, uploaded.Path)
+		return []db.Artifact{{Name: path.Base(uploaded.Path), Size: int64(len(content)), UploadLocation: uploaded.Path}}, nil
+	}
+
+	for _, name := range files {
+		content, err := os.ReadFile(filepath.Join(workDir, name))
+		if err != nil {
+			return nil, err
+		}
+		uploaded, err := client.Upload(string(content), destination+".artifacts/"+filepath.ToSlash(name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload artifact '%s' of '%s': %s", name, scriptName, err)
+		}
+		log.Debugf("Uploaded artifact '%s' of '%s' to %s", name, scriptName, uploaded.Path)
+		artifacts = append(artifacts, db.Artifact{Name: filepath.ToSlash(name), Size: int64(len(content)), UploadLocation: uploaded.Path})
+	}
+	return artifacts, nil
+}
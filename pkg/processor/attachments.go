@@ -0,0 +1,69 @@
+package processor
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/canonical/athena-core/pkg/common"
+	"github.com/canonical/athena-core/pkg/common/db"
+	"github.com/canonical/athena-core/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// validateAttachments checks the sf-attachments configuration of a subscriber.
+func validateAttachments(cfg config.Attachments) error {
+	if _, err := common.ParseSize(cfg.MaxSize); err != nil {
+		return err
+	}
+	switch cfg.Visibility {
+	case "", "AllUsers", "InternalUsers":
+		return nil
+	default:
+		return fmt.Errorf("invalid attachment visibility '%s'", cfg.Visibility)
+	}
+}
+
+// attachmentSelected returns whether the output of the script is attached to
+// the case.
+func attachmentSelected(cfg config.Attachments, report, script string) bool {
+	return slices.Contains(cfg.Scripts, script) || slices.Contains(cfg.Scripts, report+"."+script)
+}
+
+// attachOutputs attaches the selected script outputs of the report to the case
+// and records the resulting IDs in the scripts. Failing to attach an output is
+// not fatal, the output is still available on files.com.
+func (runner *ReportRunner) attachOutputs(client common.SalesforceClient, sfCase *common.Case, report *db.Report) {
+	subscriber, ok := runner.Config.Processor.SubscribeTo[report.Subscriber]
+	if !ok || len(subscriber.SFAttachments.Scripts) == 0 {
+		return
+	}
+
+	if runner.CustomerFilter != nil {
+		if reason := runner.CustomerFilter.SkipReason(sfCase.Customer); reason != "" {
+			log.Infof("Not attaching outputs to case %s: %s", sfCase.CaseNumber, reason)
+			return
+		}
+	}
+
+	maxSize, _ := common.ParseSize(subscriber.SFAttachments.MaxSize)
+	for i := range report.Scripts {
+		script := &report.Scripts[i]
+		if !attachmentSelected(subscriber.SFAttachments, report.Name, script.Name) {
+			continue
+		}
+		if maxSize > 0 && int64(len(script.Output)) > maxSize {
+			log.Warnf("Not attaching output of '%s' to case %s, %d bytes exceed the limit of %d bytes",
+				script.Name, sfCase.CaseNumber, len(script.Output), maxSize)
+			continue
+		}
+		fileName := fmt.Sprintf(DefaultReportOutputFormat, report.FileName, report.Name, script.Name)
+		attachment, err := client.AttachFile(sfCase.Id, fileName, []byte(script.Output), subscriber.SFAttachments.Visibility)
+		if err != nil {
+			log.Errorf("Failed to attach output of '%s' to case %s: %s", script.Name, sfCase.CaseNumber, err)
+			continue
+		}
+		log.Infof("Attached output of '%s' to case %s as %s", script.Name, sfCase.CaseNumber, attachment.ContentDocumentID)
+		script.ContentVersionID = attachment.ContentVersionID
+		script.ContentDocumentID = attachment.ContentDocumentID
+	}
+}
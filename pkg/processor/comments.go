@@ -0,0 +1,282 @@
+package processor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/canonical/athena-core/pkg/common"
+	"github.com/canonical/athena-core/pkg/common/db"
+	"github.com/canonical/athena-core/pkg/config"
+	"github.com/flosch/pongo2/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// What to do with the comment posted earlier for the same file and report.
+const (
+	commentModeAppend  = "append"  // Keep it and post a new comment
+	commentModeReplace = "replace" // Delete it and post a new comment
+	commentModeEdit    = "edit"    // Replace its text
+)
+
+// commentBatch is the comment posted on a case for a set of reports, split in
+// one or more chunks.
+type commentBatch struct {
+	subscriber string
+	caseId     string
+	reports    []db.Report
+	chunks     []string
+	posted     []bool       // Chunks posted by an earlier, partially failed, run
+	key        string       // Key of the comment resumed from an earlier run
+	obsolete   []db.Comment // Comments deleted once all chunks are posted
+	context    pongo2.Context
+	skipReason string // Why no comment is posted, only the actions are run
+}
+
+// batchKey identifies the comment. A resumed comment keeps the key of its
+// chunks posted earlier, even if reports joined the batch in between.
+func (b *commentBatch) batchKey() string {
+	if b.key != "" {
+		return b.key
+	}
+	var ids []uint
+	for _, report := range b.reports {
+		ids = append(ids, report.ID)
+	}
+	slices.Sort(ids)
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%v", b.subscriber, b.caseId, ids)))
+	return hex.EncodeToString(hash[:])
+}
+
+// dedupKey identifies a chunk of the comment. It only depends on the index
+// of the chunk, not on the rendered text or the number of chunks.
+func (b *commentBatch) dedupKey(chunk int) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s\n%d", b.batchKey(), chunk+1)))
+	return hex.EncodeToString(hash[:])
+}
+
+// body returns the text posted for a chunk.
+func (b *commentBatch) body(chunk int) string {
+	if len(b.chunks) > 1 {
+		return splitHeader(chunk+1, len(b.chunks)) + b.chunks[chunk]
+	}
+	return b.chunks[chunk]
+}
+
+// loadPosted marks the chunks which have already been posted. The reports
+// of a batch are not commented yet, so chunks linked to any of them were
+// posted by an earlier run which failed to post the others. They are matched
+// by index, so a chunk is not posted again if the number of chunks changed or
+// reports joined the batch in between.
+func (p *Processor) loadPosted(batch *commentBatch) {
+	batch.posted = make([]bool, len(batch.chunks))
+	if len(batch.chunks) == 0 {
+		return
+	}
+	var ids []uint
+	for _, report := range batch.reports {
+		ids = append(ids, report.ID)
+	}
+	linked := p.Db.Table("comment_reports").Select("comment_id").Where("report_id IN ?", ids)
+	var comments []db.Comment
+	if err := p.Db.Where("id IN (?)", linked).Order("id").Find(&comments).Error; err != nil {
+		log.Errorf("Failed to look up posted comments for case %s: %s", batch.caseId, err)
+		return
+	}
+	posted := 0
+	for _, comment := range comments {
+		batch.key = comment.BatchKey
+		if comment.Chunk >= 1 && comment.Chunk <= len(batch.chunks) && !batch.posted[comment.Chunk-1] {
+			batch.posted[comment.Chunk-1] = true
+			posted++
+		}
+	}
+	if len(comments) > 0 {
+		log.Infof("Resuming comment on case %s, %d of %d chunks already posted", batch.caseId, posted, len(batch.chunks))
+	}
+}
+
+// recordPosted stores the Salesforce ID of a posted chunk.
+func (p *Processor) recordPosted(batch *commentBatch, chunk int, salesforceId string, chatter bool) {
+	comment := db.Comment{
+		DedupKey:     batch.dedupKey(chunk),
+		BatchKey:     batch.batchKey(),
+		CaseID:       batch.caseId,
+		Subscriber:   batch.subscriber,
+		Chunk:        chunk + 1,
+		Chunks:       len(batch.chunks),
+		SalesforceID: salesforceId,
+		Chatter:      chatter,
+		Reports:      batch.reports,
+	}
+	if err := p.Db.Create(&comment).Error; err != nil {
+		log.Errorf("Failed to record comment %s posted on case %s: %s", salesforceId, batch.caseId, err)
+	}
+}
+
+// previousComments returns the chunks of the comments posted earlier on the
+// case for the same files and report as the batch, oldest first.
+func (p *Processor) previousComments(batch *commentBatch) ([]db.Comment, error) {
+	var paths []string
+	for _, report := range batch.reports {
+		paths = append(paths, report.FilePath)
+	}
+	reports := p.Db.Table("comment_reports").
+		Select("comment_reports.comment_id").
+		Joins("JOIN reports ON reports.id = comment_reports.report_id").
+		Where("reports.name = ? AND reports.file_path IN ?", batch.reports[0].Name, paths)
+
+	var comments []db.Comment
+	err := p.Db.Where("case_id = ? AND subscriber = ? AND batch_key != ? AND id IN (?)",
+		batch.caseId, batch.subscriber, batch.batchKey(), reports).
+		Order("id").Find(&comments).Error
+	return comments, err
+}
+
+// replacePrevious edits the comments posted earlier for the same files and
+// report, or marks them obsolete, depending on the comment mode. Chunks which
+// were edited are marked as posted. Obsolete comments are only deleted by
+// deleteObsolete once the new comment is on the case.
+func (p *Processor) replacePrevious(client common.SalesforceClient, batch *commentBatch, mode string) {
+	if len(batch.chunks) == 0 || (mode != commentModeReplace && mode != commentModeEdit) {
+		return
+	}
+	previous, err := p.previousComments(batch)
+	if err != nil {
+		log.Errorf("Failed to look up previous comments on case %s: %s", batch.caseId, err)
+		return
+	}
+	if len(previous) == 0 {
+		return
+	}
+
+	toDelete := previous
+	if mode == commentModeEdit {
+		// Edit the most recent comment and delete the chunks which are no
+		// longer needed.
+		latest := previous[len(previous)-1].BatchKey
+		toDelete = nil
+		var chunks []db.Comment
+		for _, comment := range previous {
+			if comment.BatchKey == latest {
+				chunks = append(chunks, comment)
+			}
+		}
+		slices.SortFunc(chunks, func(a, b db.Comment) int { return a.Chunk - b.Chunk })
+		for i, comment := range chunks {
+			if i >= len(batch.chunks) || batch.posted[i] {
+				toDelete = append(toDelete, comment)
+				continue
+			}
+			if err := client.UpdateComment(comment.SalesforceID, batch.body(i), comment.Chatter); err != nil {
+				log.Errorf("Failed to edit comment %s on case %s: %s", comment.SalesforceID, batch.caseId, err)
+				continue
+			}
+			log.Infof("Edited comment %s on case %s", comment.SalesforceID, batch.caseId)
+			comment.DedupKey = batch.dedupKey(i)
+			comment.BatchKey = batch.batchKey()
+			comment.Chunk = i + 1
+			comment.Chunks = len(batch.chunks)
+			if err := p.Db.Save(&comment).Error; err != nil {
+				log.Errorf("Failed to record edited comment %s: %s", comment.SalesforceID, err)
+			}
+			if err := p.Db.Model(&comment).Association("Reports").Append(batch.reports); err != nil {
+				log.Errorf("Failed to link edited comment %s to reports: %s", comment.SalesforceID, err)
+			}
+			batch.posted[i] = true
+		}
+	}
+
+	batch.obsolete = toDelete
+}
+
+// deleteObsolete deletes the comments replaced by the batch.
+func (p *Processor) deleteObsolete(client common.SalesforceClient, batch *commentBatch) {
+	for _, comment := range batch.obsolete {
+		if err := client.DeleteComment(comment.SalesforceID, comment.Chatter); err != nil {
+			log.Errorf("Failed to delete comment %s on case %s: %s", comment.SalesforceID, batch.caseId, err)
+			continue
+		}
+		log.Infof("Deleted comment %s on case %s", comment.SalesforceID, batch.caseId)
+		p.Db.Delete(&comment)
+	}
+}
+
+// What to do with a comment longer than the maximum length.
+const (
+	commentOverflowSplit    = "split"    // Post it in several comments
+	commentOverflowTruncate = "truncate" // Cut it and link to the full outputs
+	commentOverflowAttach   = "attach"   // Cut it and attach it to the case as a file
+)
+
+// fitComment returns the chunks of the comment posted according to the
+// overflow policy, a single chunk unless the comment is split.
+func (p *Processor) fitComment(comment, overflow string, reports []db.Report) []string {
+	maxLength := p.maxCommentLength()
+	if utf8.RuneCountInString(comment) <= maxLength {
+		return []string{comment}
+	}
+	switch overflow {
+	case commentOverflowTruncate:
+		log.Infof("Comment exceeds %d characters; truncating", maxLength)
+		return []string{truncateComment(comment, maxLength, p.outputLinks(reports))}
+	case commentOverflowAttach:
+		log.Infof("Comment exceeds %d characters; attaching it", maxLength)
+		notice := fmt.Sprintf("The comment was truncated, the full comment is attached to the case as %s.", commentFileName(reports))
+		return []string{truncateComment(comment, maxLength, notice)}
+	default:
+		return splitCommentWithHeaders(comment, maxLength)
+	}
+}
+
+// truncateComment cuts the comment so that it fits into maxLength together
+// with the notice appended to it.
+func truncateComment(comment string, maxLength int, notice string) string {
+	notice = "\n\n" + notice
+	if utf8.RuneCountInString(notice) >= maxLength {
+		return wrapLine(strings.TrimSpace(notice), maxLength)[0]
+	}
+	return splitComment(comment, maxLength-utf8.RuneCountInString(notice))[0] + notice
+}
+
+// outputLinks returns the notice linking a truncated comment to the full
+// outputs of the scripts on files.com.
+func (p *Processor) outputLinks(reports []db.Report) string {
+	links := []string{"The comment was truncated, the full outputs are available at:"}
+	for _, report := range reports {
+		for _, script := range report.Scripts {
+			switch {
+			case script.UploadURL != "":
+				links = append(links, script.UploadURL)
+			case script.UploadLocation != "":
+				links = append(links, filesURL(p.Config, script.UploadLocation))
+			}
+		}
+	}
+	return strings.Join(links, "\n")
+}
+
+// commentFileName returns the name of the file a comment is attached as.
+func commentFileName(reports []db.Report) string {
+	return fmt.Sprintf(DefaultReportOutputFormat, reports[0].FileName, reports[0].Name, "comment")
+}
+
+// attachComment attaches the full comment to the case, unless its truncated
+// chunk was already posted by an earlier run. If attaching fails the chunk
+// links to the outputs instead.
+func (p *Processor) attachComment(client common.SalesforceClient, batch *commentBatch, subscriber config.Subscriber, comment string) {
+	if batch.posted[0] {
+		return
+	}
+	fileName := commentFileName(batch.reports)
+	attachment, err := client.AttachFile(batch.caseId, fileName, []byte(comment), subscriber.SFAttachments.Visibility)
+	if err != nil {
+		log.Errorf("Failed to attach comment to case %s: %s", batch.caseId, err)
+		batch.chunks[0] = truncateComment(comment, p.maxCommentLength(), p.outputLinks(batch.reports))
+		return
+	}
+	log.Infof("Attached comment to case %s as %s", batch.caseId, attachment.ContentDocumentID)
+}
@@ -0,0 +1,110 @@
+package processor
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/canonical/athena-core/pkg/common/db"
+	"github.com/canonical/athena-core/pkg/config"
+	"gopkg.in/yaml.v3"
+)
+
+type condition struct {
+	config.Condition
+	output *regexp.Regexp
+}
+
+// Conditions decide whether a comment is posted or an action runs for a batch
+// of reports. All conditions have to match.
+type Conditions []condition
+
+func NewConditions(cfg []config.Condition) (Conditions, error) {
+	var conditions Conditions
+	for _, c := range cfg {
+		compiled := condition{Condition: c}
+		if c.Output != "" {
+			var err error
+			compiled.output, err = regexp.Compile(c.Output)
+			if err != nil {
+				return nil, fmt.Errorf("invalid output regex '%s': %s", c.Output, err)
+			}
+		}
+		switch c.Status {
+		case "", "success", "failure":
+		default:
+			if _, err := strconv.Atoi(c.Status); err != nil {
+				return nil, fmt.Errorf("invalid status '%s', expected success, failure or an exit code", c.Status)
+			}
+		}
+		conditions = append(conditions, compiled)
+	}
+	return conditions, nil
+}
+
+// scripts returns the scripts of the reports selected by the condition.
+func (c *condition) scripts(reports []db.Report) []db.Script {
+	var scripts []db.Script
+	for _, report := range reports {
+		if c.Report != "" && c.Report != report.Name {
+			continue
+		}
+		for _, script := range report.Scripts {
+			if c.Script == "" || c.Script == script.Name {
+				scripts = append(scripts, script)
+			}
+		}
+	}
+	return scripts
+}
+
+func (c *condition) statusMatches(code int) bool {
+	switch c.Status {
+	case "":
+		return true
+	case "success":
+		return code == 0
+	case "failure":
+		return code != 0
+	default:
+		expected, _ := strconv.Atoi(c.Status)
+		return code == expected
+	}
+}
+
+// hasYAMLKey returns whether the output is a YAML document containing the
+// dotted key.
+func hasYAMLKey(output, key string) bool {
+	var data interface{}
+	if err := yaml.Unmarshal([]byte(output), &data); err != nil {
+		return false
+	}
+	_, ok := lookupKey(data, key)
+	return ok
+}
+
+func (c *condition) match(reports []db.Report) bool {
+	for _, script := range c.scripts(reports) {
+		if c.output != nil && !c.output.MatchString(script.Output) {
+			continue
+		}
+		if !c.statusMatches(script.ExitCode) {
+			continue
+		}
+		if c.YAMLKey != "" && !hasYAMLKey(script.Output, c.YAMLKey) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// Match returns whether all conditions match the reports.
+func (c Conditions) Match(reports []db.Report) bool {
+	for i := range c {
+		if !c[i].match(reports) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package processor
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/athena-core/pkg/common"
+	"github.com/canonical/athena-core/pkg/config"
+)
+
+// Container runtimes tried in order if none is configured.
+var containerRuntimes = []string{"podman", "docker"}
+
+// Container runs scripts in a container of an OCI image with the podman or
+// docker CLI. The network is not available unless enabled.
+type Container struct {
+	config.Container
+	memory int64
+}
+
+func NewContainer(cfg config.Container) (*Container, error) {
+	container := &Container{Container: cfg}
+	if cfg.Image == "" {
+		return nil, fmt.Errorf("container runner requires an image")
+	}
+	if container.Runtime == "" {
+		for _, runtime := range containerRuntimes {
+			if _, err := exec.LookPath(runtime); err == nil {
+				container.Runtime = runtime
+				break
+			}
+		}
+		if container.Runtime == "" {
+			return nil, fmt.Errorf("no container runtime found, tried %s", strings.Join(containerRuntimes, ", "))
+		}
+	} else if _, err := exec.LookPath(container.Runtime); err != nil {
+		return nil, fmt.Errorf("container runtime '%s' not found: %s", container.Runtime, err)
+	}
+	var err error
+	if container.memory, err = common.ParseSize(cfg.Memory); err != nil {
+		return nil, fmt.Errorf("invalid container memory: %s", err)
+	}
+	if cfg.CPUs != "" {
+		if _, err := strconv.ParseFloat(cfg.CPUs, 64); err != nil {
+			return nil, fmt.Errorf("invalid container cpus '%s'", cfg.CPUs)
+		}
+	}
+	return container, nil
+}
+
+// userOptions returns the options running the scripts as the user of the
+// processor, so that Clean can remove the files they write. Podman maps the
+// user into its user namespace, other runtimes are assumed to accept the
+// docker options.
+func (c *Container) userOptions() []string {
+	if strings.Contains(filepath.Base(c.Runtime), "podman") {
+		return []string{"--userns=keep-id"}
+	}
+	return []string{"--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())}
+}
+
+// Wrap returns the command line running the script in a container which is
+// removed when the script exits. The environment variables are passed on by
+// name, their values are taken from the environment of the runtime.
+func (c *Container) Wrap(script string, args, environment []string, baseDir, workDir string) []string {
+	command := []string{c.Runtime, "run", "--rm", "--init"}
+	command = append(command, c.userOptions()...)
+	if !c.Network {
+		command = append(command, "--network", "none")
+	}
+	if c.memory > 0 {
+		command = append(command, "--memory", strconv.FormatInt(c.memory, 10))
+	}
+	if c.CPUs != "" {
+		command = append(command, "--cpus", c.CPUs)
+	}
+	command = append(command,
+		"--volume", baseDir+":"+baseDir+":ro",
+		"--volume", workDir+":"+workDir,
+		"--workdir", workDir,
+	)
+	for _, variable := range environment {
+		name, _, _ := strings.Cut(variable, "=")
+		command = append(command, "--env", name)
+	}
+	command = append(command, c.Options...)
+	command = append(command, c.Image, "bash", "-c", scriptCommand, script)
+	return append(command, args...)
+}
@@ -0,0 +1,58 @@
+package processor
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/canonical/athena-core/pkg/config"
+)
+
+// CustomerFilter decides whether a subscriber may act on cases of a given
+// customer.
+type CustomerFilter struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+func compileCustomerPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var result []*regexp.Regexp
+	for _, pattern := range patterns {
+		regex, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid customer pattern '%s': %s", pattern, err)
+		}
+		result = append(result, regex)
+	}
+	return result, nil
+}
+
+func NewCustomerFilter(cfg config.CustomerFilter) (*CustomerFilter, error) {
+	allow, err := compileCustomerPatterns(cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := compileCustomerPatterns(cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &CustomerFilter{allow: allow, deny: deny}, nil
+}
+
+// SkipReason returns why the customer is not allowed, or an empty string if
+// it is.
+func (f *CustomerFilter) SkipReason(customer string) string {
+	for _, regex := range f.deny {
+		if regex.MatchString(customer) {
+			return fmt.Sprintf("customer '%s' is on the deny list", customer)
+		}
+	}
+	if len(f.allow) == 0 {
+		return ""
+	}
+	for _, regex := range f.allow {
+		if regex.MatchString(customer) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("customer '%s' is not on the allow list", customer)
+}
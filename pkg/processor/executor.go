@@ -0,0 +1,37 @@
+package processor
+
+import (
+	"fmt"
+
+	"github.com/canonical/athena-core/pkg/config"
+)
+
+// Runners executing the scripts of a report.
+const (
+	runnerHost      = "host"
+	runnerSandbox   = "sandbox"
+	runnerContainer = "container"
+)
+
+// Executor runs scripts isolated from the host.
+type Executor interface {
+	// Wrap returns the command line running the script with the arguments
+	// and environment variables. The base directory holding the file and
+	// the scripts is read-only, the work directory inside it is writable.
+	Wrap(script string, args, environment []string, baseDir, workDir string) []string
+}
+
+// NewExecutor returns the executor of a report, or nil if its scripts run
+// directly on the host.
+func NewExecutor(report config.Report) (Executor, error) {
+	switch report.Runner {
+	case "", runnerHost:
+		return nil, nil
+	case runnerSandbox:
+		return NewSandbox(report.Sandbox)
+	case runnerContainer:
+		return NewContainer(report.Container)
+	default:
+		return nil, fmt.Errorf("unknown runner '%s'", report.Runner)
+	}
+}
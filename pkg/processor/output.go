@@ -0,0 +1,89 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/athena-core/pkg/common/db"
+	"github.com/canonical/athena-core/pkg/config"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats of script outputs.
+const (
+	outputFormatText = "text"
+	outputFormatJSON = "json"
+	outputFormatYAML = "yaml"
+)
+
+// validateOutputFormats checks the output-format of all scripts of the reports.
+func validateOutputFormats(reports map[string]config.Report) error {
+	for reportName, report := range reports {
+		for scriptName, script := range report.Scripts {
+			switch script.OutputFormat {
+			case "", outputFormatText, outputFormatJSON, outputFormatYAML:
+			default:
+				return fmt.Errorf("script '%s.%s': unknown output-format '%s'", reportName, scriptName, script.OutputFormat)
+			}
+		}
+	}
+	return nil
+}
+
+// parseOutput returns the structure of a json or yaml output, or nil for text
+// outputs.
+func parseOutput(format string, output []byte) (interface{}, error) {
+	var data interface{}
+	switch format {
+	case "", outputFormatText:
+		return nil, nil
+	case outputFormatJSON:
+		if err := json.Unmarshal(output, &data); err != nil {
+			return nil, fmt.Errorf("invalid json output: %s", err)
+		}
+	case outputFormatYAML:
+		if err := yaml.Unmarshal(output, &data); err != nil {
+			return nil, fmt.Errorf("invalid yaml output: %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown output-format '%s'", format)
+	}
+	return data, nil
+}
+
+// lookupKey returns the value of a dotted key of parsed data. Numeric parts
+// index lists.
+func lookupKey(data interface{}, key string) (interface{}, bool) {
+	for _, part := range strings.Split(key, ".") {
+		switch value := data.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if data, ok = value[part]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(value) {
+				return nil, false
+			}
+			data = value[i]
+		default:
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+// parseScriptOutputs sets the Data of the scripts of the reports from their
+// outputs so that templates can access the parsed structure.
+func parseScriptOutputs(reports []db.Report) {
+	for i := range reports {
+		for j := range reports[i].Scripts {
+			script := &reports[i].Scripts[j]
+			// The output was validated when the report was saved.
+			script.Data, _ = parseOutput(script.OutputFormat, []byte(script.Output))
+		}
+	}
+}
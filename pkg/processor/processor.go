@@ -1,15 +1,21 @@
 package processor
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/canonical/athena-core/pkg/common"
 	"github.com/canonical/athena-core/pkg/common/db"
@@ -17,22 +23,28 @@ import (
 	"github.com/flosch/pongo2/v4"
 	"github.com/lileio/pubsub/v2"
 	"github.com/lileio/pubsub/v2/middleware/defaults"
-	"github.com/simpleforce/simpleforce"
 	log "github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
 type Processor struct {
+	Actions                 map[string][]*Action
+	CaseCache               *common.CaseCache
+	CommentConditions       map[string]Conditions
 	Config                  *config.Config
+	CustomerFilters         map[string]*CustomerFilter
 	Db                      *gorm.DB
 	FilesComClientFactory   common.FilesComClientFactory
 	Hostname                string
 	Provider                pubsub.Provider
 	SalesforceClientFactory common.SalesforceClientFactory
+	Templates               *Templates
 }
 
 type BaseSubscriber struct {
+	CaseCache               *common.CaseCache
 	Config                  *config.Config
+	CustomerFilter          *CustomerFilter
 	Db                      *gorm.DB
 	FilesComClientFactory   common.FilesComClientFactory
 	Name                    string
@@ -47,61 +59,144 @@ func (s *BaseSubscriber) Setup(c *pubsub.Client) {
 
 type ReportToExecute struct {
 	File                                *db.File
+	Message                             *common.DispatchMessage
 	Name, BaseDir, Subscriber, FileName string
 	Output                              []byte
-	Scripts                             map[string]string
+	Scripts                             map[string]string   // Paths of the scripts written to BaseDir
+	ScriptBodies                        map[string]string   // run of the scripts
+	Templated                           map[string]bool     // Scripts whose run is rendered as a template
+	Environment                         []string            // Variables set for the scripts
+	Arguments                           []string            // Arguments passed to the scripts
+	Executor                            Executor            // Runs the scripts isolated from the host, nil to run them on the host
+	WorkDir                             string              // Working directory of the scripts, BaseDir if empty
+	AcceptedExitCodes                   map[string]string   // exit-codes of the scripts
+	ExitCodes                           map[string]int      // Exit codes of the scripts which ran
+	Stderr                              map[string][]byte   // Standard error of the scripts which ran
+	UploadStderr                        map[string]bool     // Scripts whose standard error is uploaded
+	Artifacts                           map[string][]string // Globs of the files uploaded for the scripts
+	ArchiveArtifacts                    map[string]bool     // Scripts whose artifacts are uploaded as an archive
+	OutputFormats                       map[string]string   // output-format of the scripts
+	UploadPath                          string              // upload-path template of the subscriber
 	Timeout                             time.Duration
 }
 
 type ReportRunner struct {
+	CaseCache                 *common.CaseCache
+	CaseNumberExtractor       *common.CaseNumberExtractor
 	Config                    *config.Config
+	CustomerFilter            *CustomerFilter
 	Db                        *gorm.DB
 	FilesComClientFactory     common.FilesComClientFactory
 	Name, Subscriber, Basedir string
 	Reports                   []ReportToExecute
 	SalesforceClientFactory   common.SalesforceClientFactory
+	Templates                 *Templates
 }
 
-func RunWithTimeout(baseDir string, timeout time.Duration, command string) ([]byte, error) {
+// scriptCommand runs the script with the arguments. Scripts without an
+// interpreter line are run by bash.
+const scriptCommand = `"$0" "$@"`
+
+// scriptStopTimeout is how long a script which timed out has to exit after
+// SIGTERM before it is killed. Container runtimes forward SIGTERM to the
+// container, which is removed once it stopped.
+const scriptStopTimeout = 10 * time.Second
+
+// runCommand runs the command and returns its standard output and error
+// separately.
+func runCommand(cmd *exec.Cmd, baseDir string, environment []string) ([]byte, []byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Dir = baseDir
+	cmd.Env = append(os.Environ(), environment...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+func RunWithTimeout(baseDir string, timeout time.Duration, command, environment []string) ([]byte, []byte, error) {
 	log.Debugf("Running script with %s timeout in %s", timeout, baseDir)
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "bash", "-c", command)
-	cmd.Dir = baseDir
-	output, err := cmd.CombinedOutput()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = scriptStopTimeout
+	stdout, stderr, err := runCommand(cmd, baseDir, environment)
 	if ctx.Err() == context.DeadlineExceeded {
-		return nil, nil
+		return nil, nil, nil
 	}
-	return output, err
+	return stdout, stderr, err
 }
 
-func RunWithoutTimeout(baseDir string, command string) ([]byte, error) {
+func RunWithoutTimeout(baseDir string, command, environment []string) ([]byte, []byte, error) {
 	log.Debugf("Running script without timeout in %s", baseDir)
-	cmd := exec.Command("bash", "-c", command)
-	cmd.Dir = baseDir
-	return cmd.CombinedOutput()
+	return runCommand(exec.Command(command[0], command[1:]...), baseDir, environment)
+}
+
+// exitCodeAccepted returns whether a script exiting with the code does not
+// fail the report. Besides 0, the codes listed in the script's exit-codes are
+// accepted, or all codes if it is "any".
+func exitCodeAccepted(accepted string, code int) bool {
+	if code == 0 || accepted == "any" {
+		return true
+	}
+	for _, field := range strings.Fields(accepted) {
+		if value, err := strconv.Atoi(field); err == nil && value == code {
+			return true
+		}
+	}
+	return false
 }
 
+// command returns the command line running the script, and the directory it
+// runs in.
+func (report *ReportToExecute) command(script string) ([]string, string) {
+	workDir := report.WorkDir
+	if workDir == "" {
+		workDir = report.BaseDir
+	}
+	if report.Executor != nil {
+		return report.Executor.Wrap(script, report.Arguments, report.Environment, report.BaseDir, workDir), workDir
+	}
+	return append([]string{"bash", "-c", scriptCommand, script}, report.Arguments...), workDir
+}
+
+// RunReport runs the scripts of the report and returns their standard output.
+// The standard error and exit codes are recorded in the report.
 func RunReport(report *ReportToExecute) (map[string][]byte, error) {
 	var output = make(map[string][]byte)
+	report.ExitCodes = make(map[string]int)
+	report.Stderr = make(map[string][]byte)
 
 	for scriptName, script := range report.Scripts {
 		log.Debugf("Running script '%s' on sosreport '%s'", scriptName, filepath.Base(report.FileName))
-		var ret []byte
+		var ret, stderr []byte
 		var err error
+		command, workDir := report.command(script)
 		if report.Timeout > 0 {
-			ret, err = RunWithTimeout(report.BaseDir, report.Timeout, script)
+			ret, stderr, err = RunWithTimeout(workDir, report.Timeout, command, report.Environment)
 		} else {
-			ret, err = RunWithoutTimeout(report.BaseDir, script)
+			ret, stderr, err = RunWithoutTimeout(workDir, command, report.Environment)
 		}
 		log.Debugf("Script '%s' on '%s' completed", scriptName, filepath.Base(report.FileName))
+		report.Stderr[scriptName] = stderr
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitCodeAccepted(report.AcceptedExitCodes[scriptName], exitErr.ExitCode()) {
+			log.Infof("Script '%s' exited with accepted code %d", scriptName, exitErr.ExitCode())
+			report.ExitCodes[scriptName] = exitErr.ExitCode()
+			output[scriptName] = ret
+			continue
+		}
 		if err != nil {
 			log.Errorf("Error occurred (test) while running script: %s", err)
-			for _, line := range strings.Split(string(ret), "\n") {
+			for _, line := range strings.Split(string(stderr), "\n") {
 				log.Error(line)
 			}
 			return nil, err
 		}
+		report.ExitCodes[scriptName] = 0
 		output[scriptName] = ret
 	}
 
@@ -110,54 +205,220 @@ func RunReport(report *ReportToExecute) (map[string][]byte, error) {
 
 const DefaultReportOutputFormat = "%s.athena-%s.%s"
 
-func (runner *ReportRunner) UploadAndSaveReport(report *ReportToExecute, caseNumber string, scriptOutputs map[string][]byte) error {
-	var file db.File
-	var uploadPath string
-	filePath := report.File.Path
-
-	log.Debugf("Fetching files for path '%s' from db", filePath)
-	result := runner.Db.Where("path = ?", filePath).First(&file)
-	if result.Error != nil {
-		return fmt.Errorf("file not found with path '%s' in database", filePath)
-	}
-
+// getCase fetches the case with the number from Salesforce.
+func (runner *ReportRunner) getCase(caseNumber string) (common.SalesforceClient, *common.Case, error) {
 	log.Infof("Fetching case with number '%s' from Salesforce", caseNumber)
 	salesforceClient, err := runner.SalesforceClientFactory.NewSalesforceClient(runner.Config)
 	if err != nil {
 		log.Errorf("failed to get Salesforce connection: %s", err)
-		return err
+		return nil, nil, err
+	}
+	var sfCase *common.Case
+	if runner.CaseCache != nil {
+		sfCase, err = runner.CaseCache.GetCase(salesforceClient, caseNumber)
+	} else {
+		sfCase, err = salesforceClient.GetCaseByNumber(caseNumber)
+	}
+	if err == nil && sfCase == nil {
+		err = fmt.Errorf("case '%s' not found", caseNumber)
 	}
-	sfCase, err := salesforceClient.GetCaseByNumber(caseNumber)
 	if err != nil {
-		log.Error(err)
-		return err
+		return nil, nil, err
 	}
-
 	log.Debugf("Case %s successfully fetched from Salesforce", sfCase)
+	return salesforceClient, sfCase, nil
+}
+
+// scriptContext returns the variables of the script templates for running
+// the report on the case, documented in the README.
+func (runner *ReportRunner) scriptContext(report *ReportToExecute, sfCase *common.Case) pongo2.Context {
+	return pongo2.Context{
+		"basedir":     runner.Basedir,                                             // base dir used to generate reports
+		"workdir":     report.WorkDir,                                             // writable directory the scripts run in
+		"file":        filepath.Base(report.File.Path),                            // file entry as returned by the files.com api client
+		"filepath":    path.Join(runner.Basedir, filepath.Base(report.File.Path)), // directory where the file lives on
+		"file_size":   report.File.Size,
+		"uploaded":    report.File.Created,
+		"case_number": sfCase.CaseNumber,
+		"case_id":     sfCase.Id,
+		"customer":    sfCase.Customer,
+		"subscriber":  report.Subscriber,
+		"report":      report.Name,
+	}
+}
+
+// usesScriptVariables returns whether the script is a template using the
+// variables of the script context, as scripts of earlier versions were.
+// Braces which are no such template, e.g. in awk, jq or Go templates, are
+// not reported.
+func usesScriptVariables(templates *Templates, script string) bool {
+	if !strings.Contains(script, "{{") && !strings.Contains(script, "{%") {
+		return false
+	}
+	probe := pongo2.Context{}
+	for name := range (&ReportRunner{}).scriptContext(&ReportToExecute{File: &db.File{}}, &common.Case{}) {
+		probe[name] = "athena-variable-" + name
+	}
+	with, err := templates.Render(probe, script)
+	if err != nil {
+		return false
+	}
+	without, err := templates.Render(pongo2.Context{}, script)
+	return err != nil || with != without
+}
+
+// contextString formats a variable of the script context for the environment
+// or the shell.
+func contextString(value interface{}) string {
+	if t, ok := value.(time.Time); ok {
+		return t.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprint(value)
+}
+
+// scriptEnvironment returns the variables of the context as ATHENA_*
+// environment variables, e.g. ATHENA_CASE_NUMBER.
+func scriptEnvironment(ctx pongo2.Context) []string {
+	var environment []string
+	for name, value := range ctx {
+		environment = append(environment, fmt.Sprintf("ATHENA_%s=%s", strings.ToUpper(name), contextString(value)))
+	}
+	slices.Sort(environment)
+	return environment
+}
+
+// shellQuote quotes the value as a single word for bash.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// shellContext returns the context with the variables shell-quoted, so that
+// values like file names cannot inject commands into rendered scripts.
+func shellContext(ctx pongo2.Context) pongo2.Context {
+	quoted := pongo2.Context{}
+	for name, value := range ctx {
+		quoted[name] = pongo2.AsSafeValue(shellQuote(contextString(value)))
+	}
+	return quoted
+}
+
+// prepareScripts writes the scripts of the report into executable files in
+// the base directory. Templated scripts are rendered for the case first.
+func (runner *ReportRunner) prepareScripts(report *ReportToExecute, sfCase *common.Case) error {
+	// Isolated scripts can only write to a private work directory.
+	report.WorkDir = runner.Basedir
+	if report.Executor != nil {
+		workDir, err := os.MkdirTemp(runner.Basedir, "work-"+report.Name+"-")
+		if err != nil {
+			return err
+		}
+		report.WorkDir = workDir
+	}
+
+	tplContext := runner.scriptContext(report, sfCase)
+	report.Environment = scriptEnvironment(tplContext)
+	report.Arguments = []string{contextString(tplContext["filepath"])}
+	report.Scripts = make(map[string]string)
+	for scriptName, body := range report.ScriptBodies {
+		fd, err := os.CreateTemp(runner.Basedir, "run-script-")
+		if err != nil {
+			return err
+		}
+		if err = fd.Chmod(0700); err != nil {
+			return err
+		}
+
+		if report.Templated[scriptName] {
+			if body, err = runner.Templates.Render(shellContext(tplContext), body); err != nil {
+				return err
+			}
+		}
+
+		if _, err = fd.WriteString(body); err != nil {
+			return err
+		}
+
+		if err = fd.Close(); err != nil {
+			return err
+		}
+		report.Scripts[scriptName] = fd.Name()
+	}
+	return nil
+}
+
+func (runner *ReportRunner) UploadAndSaveReport(report *ReportToExecute, salesforceClient common.SalesforceClient, sfCase *common.Case, scriptOutputs map[string][]byte) error {
+	var file db.File
+	filePath := report.File.Path
+
+	log.Debugf("Fetching files for path '%s' from db", filePath)
+	var result *gorm.DB
+	if report.File.ID != 0 {
+		result = runner.Db.First(&file, report.File.ID)
+	} else {
+		// Messages of older monitors do not carry the ID of the file.
+		result = runner.Db.Where("path = ?", filePath).First(&file)
+	}
+	if result.Error != nil {
+		return fmt.Errorf("file not found with path '%s' in database", filePath)
+	}
+
 	var newReport = new(db.Report)
 
 	newReport.CaseID = sfCase.Id
+	newReport.CaseNumber = sfCase.CaseNumber
 	newReport.Created = time.Now()
+	newReport.Customer = sfCase.Customer
 	newReport.FileID = file.ID
 	newReport.FileName = filepath.Base(file.Path)
 	newReport.FilePath = file.Path
+	newReport.FileSize = file.Size
+	newReport.Uploaded = file.Created
 	newReport.Name = report.Name
 	newReport.Subscriber = report.Subscriber
 
-	if runner.Config.Processor.ReportsUploadPath == "" {
-		uploadPath = filePath
-	} else {
-		uploadPath = path.Join(runner.Config.Processor.ReportsUploadPath, newReport.FileName)
-	}
-
 	filesComClient, err := runner.FilesComClientFactory.NewFilesComClient(runner.Config.FilesCom.Key, runner.Config.FilesCom.Endpoint)
 	if err != nil {
 		log.Errorf("failed to get new file.com client: %s", err)
 		return err
 	}
+
+	// The ID of the report makes the upload paths unique, so the report is
+	// created first. It is not commented on before its outputs are saved.
+	newReport.Skipped = true
+	newReport.SkipReason = "outputs not uploaded"
+	if r := runner.Db.Create(newReport); r.Error != nil {
+		log.Errorf("Failed to create new report for '%s' in db", newReport.FilePath)
+		return r.Error
+	}
+	if err := runner.uploadOutputs(filesComClient, report, newReport, scriptOutputs); err != nil {
+		runner.Db.Delete(newReport)
+		return err
+	}
+
+	runner.attachOutputs(salesforceClient, sfCase, newReport)
+
+	newReport.Skipped = false
+	newReport.SkipReason = ""
+	if r := runner.Db.Save(newReport); r.Error != nil {
+		log.Errorf("Failed to save new report for '%s' in db", newReport.FilePath)
+		return r.Error
+	}
+
+	log.Infof("Saved report '%s' in db for case id '%s'", report.Name, sfCase.CaseNumber)
+	return nil
+}
+
+// uploadOutputs uploads the outputs of the scripts to files.com and adds them
+// to the report.
+func (runner *ReportRunner) uploadOutputs(filesComClient common.FilesComClient, report *ReportToExecute, newReport *db.Report, scriptOutputs map[string][]byte) error {
 	log.Debugf("Uploading script output(s) to files.com")
+	uploadPaths, err := runner.outputUploadPaths(report, newReport, scriptOutputs)
+	if err != nil {
+		return err
+	}
 	for scriptName, output := range scriptOutputs {
-		dst_fname := fmt.Sprintf(DefaultReportOutputFormat, uploadPath, report.Name, scriptName)
+		dst_fname := uploadPaths[scriptName]
+		uploadLocation := dst_fname
 		log.Debugf("Uploading script output %s", dst_fname)
 		uploadedFilePath, err := filesComClient.Upload(string(output), dst_fname)
 		if err != nil {
@@ -165,25 +426,37 @@ func (runner *ReportRunner) UploadAndSaveReport(report *ReportToExecute, caseNum
 		}
 
 		log.Debugf("Successfully uploaded file '%s'", uploadedFilePath.Path)
+		outputFormat := report.OutputFormats[scriptName]
+		if _, err := parseOutput(outputFormat, output); err != nil {
+			log.Warnf("Treating output of script '%s' as text: %s", scriptName, err)
+			outputFormat = outputFormatText
+		}
 		script_result := db.Script{
 			Output:         string(output),
+			Stderr:         string(report.Stderr[scriptName]),
 			Name:           scriptName,
 			UploadLocation: uploadedFilePath.Path,
+			UploadURL:      filesURL(runner.Config, uploadedFilePath.Path),
+			ExitCode:       report.ExitCodes[scriptName],
+			OutputFormat:   outputFormat,
 		}
-		newReport.Scripts = append(newReport.Scripts, script_result)
-	}
 
-	if r := runner.Db.Create(newReport); r.Error != nil {
-		log.Errorf("Failed to create new report for '%s' in db", newReport.FilePath)
-		return err
-	}
+		if report.UploadStderr[scriptName] && len(report.Stderr[scriptName]) > 0 {
+			dst_fname += ".stderr"
+			log.Debugf("Uploading standard error %s", dst_fname)
+			uploadedFilePath, err := filesComClient.Upload(script_result.Stderr, dst_fname)
+			if err != nil {
+				return fmt.Errorf("failed to upload file '%s': %s", dst_fname, err.Error())
+			}
+			script_result.StderrUploadLocation = uploadedFilePath.Path
+		}
 
-	if r := runner.Db.Save(newReport); r.Error != nil {
-		log.Errorf("Failed to save new report for '%s' in db", newReport.FilePath)
-		return err
+		script_result.Artifacts, err = uploadArtifacts(filesComClient, report, scriptName, uploadLocation)
+		if err != nil {
+			return err
+		}
+		newReport.Scripts = append(newReport.Scripts, script_result)
 	}
-
-	log.Infof("Saved report '%s' in db for case id '%s'", report.Name, sfCase.CaseNumber)
 	return nil
 }
 
@@ -191,9 +464,23 @@ func (runner *ReportRunner) Run(reportFn func(report *ReportToExecute) (map[stri
 	for _, report := range runner.Reports {
 		var err error
 
-		caseNumber, err := common.GetCaseNumberFromFilename(report.File.Path)
+		caseNumber := report.Message.CaseNumber
+		if caseNumber == "" {
+			caseNumber, _, err = runner.CaseNumberExtractor.Extract(report.File.Path)
+			if err != nil {
+				log.Info(err)
+				continue
+			}
+		}
+
+		salesforceClient, sfCase, err := runner.getCase(caseNumber)
 		if err != nil {
-			log.Info(err)
+			log.Error(err)
+			continue
+		}
+
+		if err := runner.prepareScripts(&report, sfCase); err != nil {
+			log.Errorf("Failed to prepare scripts of '%s': %s", report.Name, err)
 			continue
 		}
 
@@ -205,7 +492,7 @@ func (runner *ReportRunner) Run(reportFn func(report *ReportToExecute) (map[stri
 		}
 
 		log.Debugf("Uploading and saving results of running '%s' on '%s' (count=%d)", report.Name, report.FileName, len(scriptOutputs))
-		if err := runner.UploadAndSaveReport(&report, caseNumber, scriptOutputs); err != nil {
+		if err := runner.UploadAndSaveReport(&report, salesforceClient, sfCase, scriptOutputs); err != nil {
 			log.Errorf("Failed to upload and save output of '%s': %s", report.Name, err)
 			continue
 		}
@@ -216,25 +503,26 @@ func (runner *ReportRunner) Run(reportFn func(report *ReportToExecute) (map[stri
 
 const DefaultExecutionTimeout = "0s"
 
-func renderTemplate(ctx *pongo2.Context, data string) (string, error) {
-	tpl, err := pongo2.FromString(data)
-	if err != nil {
-		return "", err
-	}
-	out, err := tpl.Execute(*ctx)
-	if err != nil {
-		return "", err
-	}
-	return out, nil
-}
-
 func NewReportRunner(cfg *config.Config, dbConn *gorm.DB,
 	salesforceClientFactory common.SalesforceClientFactory,
 	filesComClientFactory common.FilesComClientFactory,
 	subscriber, name string,
-	file *db.File, reports map[string]config.Report) (*ReportRunner, error) {
+	message *common.DispatchMessage, reports map[string]config.Report) (*ReportRunner, error) {
 
 	var reportRunner ReportRunner
+	var err error
+	file := message.File()
+
+	// Sidecar files are only available to the monitor.
+	reportRunner.CaseNumberExtractor, err = common.NewCaseNumberExtractor(&cfg.CaseNumber, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	templates, err := NewTemplates(cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	basePath := cfg.Processor.BaseTmpDir
 	if basePath == "" {
@@ -268,45 +556,31 @@ func NewReportRunner(cfg *config.Config, dbConn *gorm.DB,
 	reportRunner.Name = name
 	reportRunner.SalesforceClientFactory = salesforceClientFactory
 	reportRunner.Subscriber = subscriber
+	reportRunner.Templates = templates
+	uploadPath := cfg.Processor.SubscribeTo[subscriber].UploadPath
 
-	//TODO: document the template variables
-	tplContext := pongo2.Context{
-		"basedir":  reportRunner.Basedir,                                      // base dir used to generate reports
-		"file":     filepath.Base(file.Path),                                  // file entry as returned by the files.com api client
-		"filepath": path.Join(reportRunner.Basedir, filepath.Base(file.Path)), // directory where the file lives on
-	}
-
-	var scripts = make(map[string]string)
-
+	// The scripts are written once the case is known.
 	for reportName, report := range reports {
+		var scripts = make(map[string]string)
+		var templated = make(map[string]bool)
+		var uploadStderr = make(map[string]bool)
+		var artifacts = make(map[string][]string)
+		var archiveArtifacts = make(map[string]bool)
+		var exitCodes = make(map[string]string)
+		var outputFormats = make(map[string]string)
 		log.Debugf("running %d '%s' script(s)", len(report.Scripts), reportName)
 		for scriptName, script := range report.Scripts {
 			if script.Run == "" {
 				log.Errorf("No script provided to run on '%s'", scriptName)
 				continue
 			}
-			fd, err := os.CreateTemp(reportRunner.Basedir, "run-script-")
-			if err != nil {
-				return nil, err
-			}
-			if err = fd.Chmod(0700); err != nil {
-				return nil, err
-			}
-
-			out, err := renderTemplate(&tplContext, script.Run)
-			if err != nil {
-				return nil, err
-			}
-
-			if _, err = fd.WriteString(out); err != nil {
-				return nil, err
-			}
-
-			if err = fd.Close(); err != nil {
-				return nil, err
-			}
-
-			scripts[scriptName] = fd.Name()
+			scripts[scriptName] = script.Run
+			templated[scriptName] = script.Template != nil && *script.Template
+			uploadStderr[scriptName] = script.UploadStderr
+			artifacts[scriptName] = script.Artifacts
+			archiveArtifacts[scriptName] = script.ArtifactsArchive
+			exitCodes[scriptName] = script.ExitCodes
+			outputFormats[scriptName] = script.OutputFormat
 		}
 
 		timeout, err := time.ParseDuration(report.Timeout)
@@ -314,12 +588,26 @@ func NewReportRunner(cfg *config.Config, dbConn *gorm.DB,
 			timeout, _ = time.ParseDuration(DefaultExecutionTimeout)
 		}
 
+		executor, err := NewExecutor(report)
+		if err != nil {
+			return nil, fmt.Errorf("report '%s': %s", reportName, err)
+		}
+
 		reportToExecute := ReportToExecute{}
 		reportToExecute.BaseDir = reportRunner.Basedir
 		reportToExecute.File = file
+		reportToExecute.Message = message
 		reportToExecute.FileName = file.Path
 		reportToExecute.Name = reportName
-		reportToExecute.Scripts = scripts
+		reportToExecute.ScriptBodies = scripts
+		reportToExecute.Templated = templated
+		reportToExecute.UploadStderr = uploadStderr
+		reportToExecute.Artifacts = artifacts
+		reportToExecute.ArchiveArtifacts = archiveArtifacts
+		reportToExecute.Executor = executor
+		reportToExecute.AcceptedExitCodes = exitCodes
+		reportToExecute.OutputFormats = outputFormats
+		reportToExecute.UploadPath = uploadPath
 		reportToExecute.Subscriber = reportRunner.Subscriber
 		reportToExecute.Timeout = timeout
 		reportRunner.Reports = append(reportRunner.Reports, reportToExecute)
@@ -337,13 +625,35 @@ func (runner *ReportRunner) Clean() error {
 	return os.RemoveAll(runner.Basedir)
 }
 
-func (s *BaseSubscriber) Handler(_ context.Context, file *db.File, msg *pubsub.Msg) error {
-	runner, err := NewReportRunner(s.Config, s.Db, s.SalesforceClientFactory, s.FilesComClientFactory, s.Name, s.Options.Topic, file, s.Reports)
+// selectReports returns the named subset of reports, or all reports if no
+// names are given.
+func selectReports(reports map[string]config.Report, names []string) map[string]config.Report {
+	if len(names) == 0 {
+		return reports
+	}
+	results := make(map[string]config.Report)
+	for _, name := range names {
+		report, ok := reports[name]
+		if !ok {
+			log.Warnf("Report '%s' requested but not configured - skipping", name)
+			continue
+		}
+		results[name] = report
+	}
+	return results
+}
+
+func (s *BaseSubscriber) Handler(_ context.Context, message *common.DispatchMessage, msg *pubsub.Msg) error {
+	log.Infof("Received file %s (version=%d, case=%s, rule=%s, monitor=%s, correlation-id=%s)",
+		message.Path, message.Version, message.CaseNumber, message.Rule, message.Monitor, message.CorrelationID)
+	runner, err := NewReportRunner(s.Config, s.Db, s.SalesforceClientFactory, s.FilesComClientFactory, s.Name, s.Options.Topic, message, selectReports(s.Reports, message.Reports))
 	if err != nil {
 		log.Errorf("Failed to get new runner: %s", err)
 		msg.Ack()
 		return err
 	}
+	runner.CaseCache = s.CaseCache
+	runner.CustomerFilter = s.CustomerFilter
 	if err := runner.Run(RunReport); err != nil {
 		log.Errorf("Runner failed: %s", err)
 		msg.Ack()
@@ -370,6 +680,13 @@ func NewBaseSubscriber(
 		Reports: reports,
 	}
 
+	caseCache, err := common.NewCaseCacheFromConfig(cfg, dbConn)
+	if err != nil {
+		log.Errorf("Invalid case cache configuration, not caching cases: %s", err)
+		caseCache = common.NewCaseCache(dbConn, 0)
+	}
+
+	subscriber.CaseCache = caseCache
 	subscriber.Config = cfg
 	subscriber.Db = dbConn
 	subscriber.FilesComClientFactory = filesComClientFactory
@@ -382,7 +699,92 @@ func NewBaseSubscriber(
 func NewProcessor(
 	filesComClientFactory common.FilesComClientFactory, salesforceClientFactory common.SalesforceClientFactory,
 	provider pubsub.Provider, cfg *config.Config, dbConn *gorm.DB) (*Processor, error) {
-	var err error
+	if _, err := common.NewCaseNumberExtractor(&cfg.CaseNumber, nil); err != nil {
+		return nil, err
+	}
+
+	if _, err := common.NewCaseCacheFromConfig(cfg, dbConn); err != nil {
+		return nil, err
+	}
+
+	templates, err := NewTemplates(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	actions := make(map[string][]*Action)
+	commentConditions := make(map[string]Conditions)
+	customerFilters := make(map[string]*CustomerFilter)
+	for name, subscriber := range cfg.Processor.SubscribeTo {
+		filter, err := NewCustomerFilter(subscriber.SFCommentCustomers)
+		if err != nil {
+			return nil, fmt.Errorf("subscriber '%s': %s", name, err)
+		}
+		customerFilters[name] = filter
+
+		commentConditions[name], err = NewConditions(subscriber.CommentWhen)
+		if err != nil {
+			return nil, fmt.Errorf("subscriber '%s': comment-when: %s", name, err)
+		}
+
+		actions[name], err = NewActions(subscriber.Actions, templates)
+		if err != nil {
+			return nil, fmt.Errorf("subscriber '%s': %s", name, err)
+		}
+
+		if err := templates.Check(subscriber.SFComment); err != nil {
+			return nil, fmt.Errorf("subscriber '%s': invalid sf-comment template: %s", name, err)
+		}
+		if err := templates.Check(subscriber.UploadPath); err != nil {
+			return nil, fmt.Errorf("subscriber '%s': invalid upload-path template: %s", name, err)
+		}
+		for reportName, report := range subscriber.Reports {
+			if _, err := NewExecutor(report); err != nil {
+				return nil, fmt.Errorf("subscriber '%s': report '%s': %s", name, reportName, err)
+			}
+			for scriptName, script := range report.Scripts {
+				if script.Template == nil {
+					// Scripts used to be rendered as templates, refuse to run
+					// their variables literally.
+					if usesScriptVariables(templates, script.Run) {
+						return nil, fmt.Errorf("subscriber '%s': script '%s.%s' uses template variables without 'template: true' or 'template: false'", name, reportName, scriptName)
+					}
+					continue
+				}
+				if !*script.Template {
+					continue
+				}
+				if err := templates.Check(script.Run); err != nil {
+					return nil, fmt.Errorf("subscriber '%s': invalid template of script '%s.%s': %s", name, reportName, scriptName, err)
+				}
+			}
+		}
+
+		if err := validateAttachments(subscriber.SFAttachments); err != nil {
+			return nil, fmt.Errorf("subscriber '%s': %s", name, err)
+		}
+
+		if err := validateOutputFormats(subscriber.Reports); err != nil {
+			return nil, fmt.Errorf("subscriber '%s': %s", name, err)
+		}
+
+		if err := validateArtifacts(subscriber.Reports); err != nil {
+			return nil, fmt.Errorf("subscriber '%s': %s", name, err)
+		}
+
+		switch subscriber.SFCommentMode {
+		case "", commentModeAppend, commentModeReplace, commentModeEdit:
+		default:
+			return nil, fmt.Errorf("subscriber '%s': unknown sf-comment-mode '%s'", name, subscriber.SFCommentMode)
+		}
+
+		switch subscriber.SFCommentOverflow {
+		case "", commentOverflowSplit, commentOverflowTruncate, commentOverflowAttach:
+		default:
+			return nil, fmt.Errorf("subscriber '%s': unknown sf-comment-overflow '%s'", name, subscriber.SFCommentOverflow)
+		}
+	}
+
 	if dbConn == nil {
 		dbConn, err = db.GetDBConn(cfg)
 		if err != nil {
@@ -395,13 +797,23 @@ func NewProcessor(
 		return nil, err
 	}
 
+	caseCache, err := common.NewCaseCacheFromConfig(cfg, dbConn)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Processor{
+		Actions:                 actions,
+		CaseCache:               caseCache,
+		CommentConditions:       commentConditions,
 		Config:                  cfg,
+		CustomerFilters:         customerFilters,
 		Db:                      dbConn,
 		FilesComClientFactory:   filesComClientFactory,
 		Hostname:                hostname,
 		Provider:                provider,
 		SalesforceClientFactory: salesforceClientFactory,
+		Templates:               templates,
 	}, nil
 }
 
@@ -417,27 +829,78 @@ func (p *Processor) getReportsByTopic(topic string) map[string]config.Report {
 	return results
 }
 
-var reportMap map[string]map[string]map[string][]db.Report
+// Maximum lengths of case comments and chatter posts accepted by Salesforce.
+const (
+	caseCommentMaxLength = 4000
+	chatterPostMaxLength = 10000
+)
+
+// maxCommentLength returns the maximum length of the comments, which depends
+// on whether they are posted to chatter.
+func (p *Processor) maxCommentLength() int {
+	maxLength, limit := p.Config.Salesforce.MaxCommentLength, caseCommentMaxLength
+	if p.Config.Salesforce.EnableChatter {
+		limit = chatterPostMaxLength
+		if p.Config.Salesforce.MaxChatterLength > 0 {
+			maxLength = p.Config.Salesforce.MaxChatterLength
+		}
+	}
+	if maxLength <= 0 || maxLength > limit {
+		return limit
+	}
+	return maxLength
+}
+
+// runeOffset returns the byte offset of the rune at the index of the string,
+// or its length if it is shorter.
+func runeOffset(s string, index int) int {
+	for offset := range s {
+		if index == 0 {
+			return offset
+		}
+		index--
+	}
+	return len(s)
+}
+
+// wrapLine breaks a line longer than maxLength characters into several lines,
+// at spaces if possible.
+func wrapLine(line string, maxLength int) []string {
+	var lines []string
+	for maxLength > 0 && utf8.RuneCountInString(line) > maxLength {
+		cut := runeOffset(line, maxLength)
+		if space := strings.LastIndex(line[:cut], " "); space > 0 {
+			cut = space
+		}
+		lines = append(lines, line[:cut])
+		line = strings.TrimLeft(line[cut:], " ")
+	}
+	return append(lines, line)
+}
 
 // splitComment splits the given comment into several pieces at most
-// maxLength characters long.
+// maxLength characters long. Lines longer than maxLength are wrapped.
 // The function returns the resulting slice.
 func splitComment(comment string, maxLength int) []string {
 	// Check length and split across MaxCommentLength character
 	// boundaries.
-	if len(comment) > maxLength {
+	if utf8.RuneCountInString(comment) > maxLength {
 		log.Infof("Comment exceeds %d characters; splitting", maxLength)
 		var commentChunks []string = []string{}
-		commentLines := strings.Split(strings.TrimRight(comment, "\n "), "\n")
+		var commentLines []string
+		for _, line := range strings.Split(strings.TrimRight(comment, "\n "), "\n") {
+			commentLines = append(commentLines, wrapLine(line, maxLength)...)
+		}
 		chunk := []string{}
 		chunkLength := 0
 		for _, line := range commentLines {
-			if chunkLength+len(line) < maxLength || len(chunk) == 0 {
-				chunkLength += len(line) + 1 // Account for newline
+			lineLength := utf8.RuneCountInString(line)
+			if chunkLength+lineLength < maxLength || len(chunk) == 0 {
+				chunkLength += lineLength + 1 // Account for newline
 				chunk = append(chunk, line)
 			} else {
 				commentChunks = append(commentChunks, strings.Join(chunk, "\n"))
-				chunkLength = len(line) + 1 // Account for newline
+				chunkLength = lineLength + 1 // Account for newline
 				chunk = []string{line}
 			}
 		}
@@ -449,14 +912,47 @@ func splitComment(comment string, maxLength int) []string {
 	}
 }
 
+// splitHeader returns the header of a chunk of a split comment.
+func splitHeader(chunk, chunks int) string {
+	return fmt.Sprintf("Split comment %d of %d\n\n", chunk, chunks)
+}
+
+// splitCommentWithHeaders splits the comment so that every chunk fits into
+// maxLength characters together with its header. The header grows with the
+// number of chunks, so the comment is split again until the room reserved
+// for it suffices.
+func splitCommentWithHeaders(comment string, maxLength int) []string {
+	chunks := 2
+	for {
+		reserved := len(splitHeader(chunks, chunks))
+		commentChunks := splitComment(comment, maxLength-reserved)
+		if len(splitHeader(len(commentChunks), len(commentChunks))) <= reserved {
+			return commentChunks
+		}
+		chunks = len(commentChunks)
+	}
+}
+
+// getCase returns the case of the report. The case is fetched from Salesforce,
+// or from the cache, for its additional fields. Reports saved before case
+// numbers were recorded only have the case ID and customer.
+func (p *Processor) getCase(client common.SalesforceClient, report db.Report) *common.Case {
+	if report.CaseNumber != "" {
+		sfCase, err := p.CaseCache.GetCase(client, report.CaseNumber)
+		if err == nil && sfCase != nil {
+			return sfCase
+		}
+		log.Warnf("Failed to fetch case %s: %v", report.CaseNumber, err)
+	}
+	return &common.Case{Id: report.CaseID, CaseNumber: report.CaseNumber, Customer: report.Customer}
+}
+
 func (p *Processor) BatchSalesforceComments(ctx *context.Context, interval time.Duration) {
 	var reports []db.Report
-	if reportMap == nil {
-		reportMap = make(map[string]map[string]map[string][]db.Report)
-	}
+	reportMap := make(map[string]map[string]map[string][]db.Report)
 
 	log.Infof("Running process to send batched comments to salesforce every %s", interval)
-	if results := p.Db.Preload("Scripts").Where("created <= ? and commented = ?", time.Now().Add(-interval), false).Find(&reports); results.Error != nil {
+	if results := p.Db.Preload("Scripts.Artifacts").Where("created <= ? and commented = ? and skipped = ?", time.Now().Add(-interval), false, false).Find(&reports); results.Error != nil {
 		log.Errorf("Error getting batched comments: %s", results.Error)
 		return
 	}
@@ -487,6 +983,11 @@ func (p *Processor) BatchSalesforceComments(ctx *context.Context, interval time.
 		log.Errorf("failed to get Salesforce client: %s", err)
 		return
 	}
+
+	// Render all comments first and post them together so that Salesforce
+	// is called once per 200 comments instead of once per comment.
+	var batches []commentBatch
+	var comments []common.Comment
 	for subscriberName, caseMap := range reportMap {
 		for caseId, reportsByType := range caseMap {
 			for _, reports := range reportsByType {
@@ -497,59 +998,148 @@ func (p *Processor) BatchSalesforceComments(ctx *context.Context, interval time.
 					continue
 				}
 
-				if !subscriber.SFCommentEnabled {
+				if !subscriber.SFCommentEnabled && len(p.Actions[subscriberName]) == 0 {
 					log.Warnf("Salesforce comments have been disabled, skipping comments")
 					continue
 				}
 
-				//TODO: document variables
-				tplContext = pongo2.Context{
-					"processor":  p.Hostname,
-					"subscriber": subscriberName,
-					"reports":    reports,
+				// Reports saved by older processors do not know the customer.
+				sfCase := p.getCase(salesforceClient, reports[0])
+				if filter, ok := p.CustomerFilters[subscriberName]; ok {
+					if reason := filter.SkipReason(sfCase.Customer); reason != "" {
+						log.Infof("Not commenting on case %s: %s", caseId, reason)
+						for _, report := range reports {
+							report.Skipped = true
+							report.SkipReason = reason
+							p.Db.Save(&report)
+						}
+						continue
+					}
 				}
 
-				renderedComment, err := renderTemplate(&tplContext, subscriber.SFComment)
-				if err != nil {
-					log.Error(err)
-					continue
+				parseScriptOutputs(reports)
+
+				// Variables of the comment and action templates, documented in the README.
+				tplContext = pongo2.Context{
+					"processor":   p.Hostname,
+					"subscriber":  subscriberName,
+					"reports":     reports,
+					"report":      reports[0].Name,
+					"case":        sfCase,
+					"case_number": sfCase.CaseNumber,
+					"case_id":     caseId,
+					"customer":    sfCase.Customer,
+					"case_link":   caseLink(salesforceClient.GetLoc()),
 				}
 
-				log.Infof("Processing comment for case %s", caseId)
-				commentChunks := splitComment(renderedComment, p.Config.Salesforce.MaxCommentLength)
+				commentEnabled := subscriber.SFCommentEnabled
+				var skipReason string
+				if commentEnabled && !p.CommentConditions[subscriberName].Match(reports) {
+					skipReason = "comment-when conditions not met"
+					log.Infof("Not commenting on case %s: %s", caseId, skipReason)
+					commentEnabled = false
+					if len(p.Actions[subscriberName]) == 0 {
+						for _, report := range reports {
+							report.Skipped = true
+							report.SkipReason = skipReason
+							p.Db.Save(&report)
+						}
+						continue
+					}
+				}
 
-				wasPosted := true
-				for i, chunk := range commentChunks {
-					var chunkHeader string
-					if len(commentChunks) > 1 {
-						chunkHeader = fmt.Sprintf("Split comment %d of %d\n\n", i+1, len(commentChunks))
+				// Without comments only the actions are run.
+				var commentChunks []string
+				var attachComment string // Too long to be posted, attached to the case instead
+				if commentEnabled {
+					renderedComment, err := p.Templates.Render(tplContext, subscriber.SFComment)
+					if err != nil {
+						log.Error(err)
+						continue
 					}
-					var comment *simpleforce.SObject
-					if p.Config.Salesforce.EnableChatter {
-						comment = salesforceClient.PostChatter(caseId,
-							chunkHeader+chunk, subscriber.SFCommentIsPublic)
-					} else {
-						comment = salesforceClient.PostComment(caseId,
-							chunkHeader+chunk, subscriber.SFCommentIsPublic)
+
+					log.Infof("Processing comment for case %s", caseId)
+					commentChunks = p.fitComment(renderedComment, subscriber.SFCommentOverflow, reports)
+					if subscriber.SFCommentOverflow == commentOverflowAttach && utf8.RuneCountInString(renderedComment) > p.maxCommentLength() {
+						attachComment = renderedComment
 					}
-					if comment == nil {
-						log.Errorf("Failed to post comment to case id: %s", caseId)
-						wasPosted = false
+				}
+				batch := commentBatch{subscriber: subscriberName, caseId: caseId, reports: reports, chunks: commentChunks, context: tplContext, skipReason: skipReason}
+				p.loadPosted(&batch)
+				if attachComment != "" {
+					p.attachComment(salesforceClient, &batch, subscriber, attachComment)
+				}
+				p.replacePrevious(salesforceClient, &batch, subscriber.SFCommentMode)
+				batches = append(batches, batch)
+				for i := range commentChunks {
+					if batch.posted[i] {
 						continue
 					}
+					comments = append(comments, common.Comment{
+						CaseID:   caseId,
+						Body:     batch.body(i),
+						IsPublic: subscriber.SFCommentIsPublic,
+					})
 				}
+			}
+		}
+	}
 
-				if wasPosted {
-					log.Infof("Successfully posted comment on case %s for %d reports", caseId, len(reports))
-					for _, report := range reports {
-						report.Commented = true
-						p.Db.Save(report)
-					}
-					reportMap = nil
-				} else {
-					log.Errorf("Could not post comment to case id: %s", caseId)
+	if len(batches) == 0 {
+		return
+	}
+
+	var results []common.CommentResult
+	if len(comments) > 0 {
+		results, err = salesforceClient.PostComments(comments, p.Config.Salesforce.EnableChatter)
+		if err != nil {
+			log.Errorf("Failed to post comments: %s", err)
+		}
+	}
+
+	// Only mark the reports whose comments were posted completely, the others
+	// are retried with the next batch.
+	next := 0
+	for _, batch := range batches {
+		wasPosted := true
+		for i := range batch.chunks {
+			if batch.posted[i] {
+				continue
+			}
+			if next >= len(results) || !results[next].Success {
+				if next < len(results) {
+					log.Errorf("Failed to post comment to case id %s: %s", batch.caseId, results[next].Error)
 				}
+				wasPosted = false
+			} else {
+				p.recordPosted(&batch, i, results[next].ID, p.Config.Salesforce.EnableChatter)
 			}
+			next++
+		}
+
+		// The comments it replaces are deleted and the actions run once the
+		// comment is on the case.
+		if wasPosted {
+			p.deleteObsolete(salesforceClient, &batch)
+			wasPosted = p.runActions(salesforceClient, &batch, batch.context)
+		}
+
+		if wasPosted && batch.skipReason != "" {
+			// The actions ran, but the reports were not commented on.
+			log.Infof("Ran the actions on case %s for %d reports without a comment", batch.caseId, len(batch.reports))
+			for _, report := range batch.reports {
+				report.Skipped = true
+				report.SkipReason = batch.skipReason
+				p.Db.Save(&report)
+			}
+		} else if wasPosted {
+			log.Infof("Successfully posted comment on case %s for %d reports", batch.caseId, len(batch.reports))
+			for _, report := range batch.reports {
+				report.Commented = true
+				p.Db.Save(&report)
+			}
+		} else {
+			log.Errorf("Could not post comment to case id: %s", batch.caseId)
 		}
 	}
 }
@@ -573,8 +1163,13 @@ func (p *Processor) Run(ctx context.Context, newSubscriberFn func(
 	})
 
 	for event := range p.Config.Processor.SubscribeTo {
-		go pubsub.Subscribe(newSubscriberFn(p.FilesComClientFactory, p.SalesforceClientFactory,
-			p.Hostname, event, p.getReportsByTopic(event), p.Config, p.Db))
+		subscriber := newSubscriberFn(p.FilesComClientFactory, p.SalesforceClientFactory,
+			p.Hostname, event, p.getReportsByTopic(event), p.Config, p.Db)
+		// Share the filters compiled by NewProcessor with the subscribers.
+		if base, ok := subscriber.(*BaseSubscriber); ok {
+			base.CustomerFilter = p.CustomerFilters[event]
+		}
+		go pubsub.Subscribe(subscriber)
 	}
 
 	interval, err := time.ParseDuration(p.Config.Processor.BatchCommentsEvery)
@@ -1,16 +1,28 @@
 package processor
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/canonical/athena-core/pkg/common"
 	"github.com/canonical/athena-core/pkg/common/db"
 	"github.com/canonical/athena-core/pkg/common/test"
 	"github.com/canonical/athena-core/pkg/config"
+	"github.com/flosch/pongo2/v4"
 	"github.com/lileio/pubsub/v2"
 	"github.com/lileio/pubsub/v2/providers/memory"
 	"github.com/sirupsen/logrus"
@@ -35,7 +47,7 @@ func (s *ProcessorTestSuite) SetupTest() {
 	s.config, _ = config.NewConfigFromBytes([]byte(test.DefaultTestConfig))
 	assert.Equal(s.T(), "sqlite", s.config.Db.Dialect)
 	s.db, _ = gorm.Open(sqlite.Open("file::memory:?cache=shared"))
-	s.db.AutoMigrate(db.File{}, db.Report{})
+	s.db.AutoMigrate(db.File{}, db.Report{}, db.Case{})
 }
 
 type MockSubscriber struct {
@@ -54,8 +66,9 @@ func (s *ProcessorTestSuite) TestRunProcessor() {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 
-	b, _ := json.Marshal(db.File{Path: "/uploads/sosreport-123.tar.xz"})
-	b1, _ := json.Marshal(db.File{Path: "/uploads/sosreport-321.tar.xz"})
+	b, _ := json.Marshal(common.NewDispatchMessage(&db.File{Path: "/uploads/sosreport-123.tar.xz"}))
+	b1, _ := json.Marshal(common.NewDispatchMessage(&db.File{Path: "/uploads/sosreport-321.tar.xz"}))
+	// Messages published by older monitors carry the raw db.File.
 	b2, _ := json.Marshal(db.File{Path: "/uploads/sosreport-abc.tar.xz"})
 
 	_ = provider.Publish(context.Background(), "sosreports", &pubsub.Msg{Data: b})
@@ -75,7 +88,7 @@ func (s *ProcessorTestSuite) TestRunProcessor() {
 			JSON:    true,
 		}}
 
-		subscriber.Options.Handler = func(ctx context.Context, msg *db.File, m *pubsub.Msg) error {
+		subscriber.Options.Handler = func(ctx context.Context, msg *common.DispatchMessage, m *pubsub.Msg) error {
 			called++
 			return nil
 		}
@@ -95,6 +108,8 @@ func TestSplitComment(t *testing.T) {
 		"123456789\n",
 		"1234\n567890\n123\n",
 		"1234567890123456789",
+		"12345 7890 123456789",
+		"ééééééééééééé",
 	}
 	var expected [][]string = [][]string{
 		{
@@ -105,7 +120,16 @@ func TestSplitComment(t *testing.T) {
 			"123",
 		},
 		{
-			"1234567890123456789",
+			"123456789012",
+			"3456789",
+		},
+		{
+			"12345 7890",
+			"123456789",
+		},
+		{
+			"éééééééééééé",
+			"é",
 		},
 	}
 	var got []string = []string{}
@@ -114,3 +138,942 @@ func TestSplitComment(t *testing.T) {
 		assert.Equal(t, expected[i], got)
 	}
 }
+
+func TestSplitCommentWithHeaders(t *testing.T) {
+	chunks := splitCommentWithHeaders(strings.Repeat("x", 300), 30)
+	assert.Len(t, chunks, 50)
+	for i, chunk := range chunks {
+		assert.LessOrEqual(t, utf8.RuneCountInString(splitHeader(i+1, len(chunks))+chunk), 30)
+	}
+}
+
+func TestCustomerFilter(t *testing.T) {
+	filter, err := NewCustomerFilter(config.CustomerFilter{})
+	assert.Nil(t, err)
+	assert.Empty(t, filter.SkipReason("ACME"))
+
+	filter, err = NewCustomerFilter(config.CustomerFilter{Deny: []string{"ACME.*"}})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, filter.SkipReason("ACME Inc."))
+	assert.Empty(t, filter.SkipReason("Not ACME"))
+
+	filter, err = NewCustomerFilter(config.CustomerFilter{Allow: []string{"ACME", "Initech"}, Deny: []string{"Initech"}})
+	assert.Nil(t, err)
+	assert.Empty(t, filter.SkipReason("ACME"))
+	assert.NotEmpty(t, filter.SkipReason("ACME Inc."))
+	assert.NotEmpty(t, filter.SkipReason("Initech"))
+	assert.NotEmpty(t, filter.SkipReason(""))
+
+	_, err = NewCustomerFilter(config.CustomerFilter{Allow: []string{"("}})
+	assert.NotNil(t, err)
+}
+
+func TestSelectReports(t *testing.T) {
+	reports := map[string]config.Report{
+		"hotsos":    {Timeout: "1m"},
+		"crashdump": {Timeout: "2m"},
+	}
+
+	assert.Equal(t, reports, selectReports(reports, nil))
+	assert.Equal(t, map[string]config.Report{"crashdump": {Timeout: "2m"}}, selectReports(reports, []string{"crashdump"}))
+	assert.Equal(t, map[string]config.Report{"hotsos": {Timeout: "1m"}}, selectReports(reports, []string{"hotsos", "unknown"}))
+}
+
+// FailingSalesforceClient fails to post the comments matching fail.
+type FailingSalesforceClient struct {
+	test.SalesforceClient
+	fail     func(comment common.Comment) bool
+	posted   []common.Comment
+	updated  []string
+	deleted  []string
+	fields   map[string]string
+	attached []string
+	cases    map[string]*common.Case
+}
+
+func (sf *FailingSalesforceClient) GetCaseByNumber(number string) (*common.Case, error) {
+	return sf.cases[number], nil
+}
+
+func (sf *FailingSalesforceClient) AttachFile(caseId, fileName string, content []byte, visibility string) (*common.Attachment, error) {
+	sf.attached = append(sf.attached, fileName)
+	return sf.SalesforceClient.AttachFile(caseId, fileName, content, visibility)
+}
+
+func (sf *FailingSalesforceClient) UpdateCase(caseId string, fields map[string]string) error {
+	if sf.fields == nil {
+		sf.fields = make(map[string]string)
+	}
+	for field, value := range fields {
+		sf.fields[field] = value
+	}
+	return nil
+}
+
+func (sf *FailingSalesforceClient) UpdateComment(id, body string, chatter bool) error {
+	sf.updated = append(sf.updated, id)
+	return nil
+}
+
+func (sf *FailingSalesforceClient) DeleteComment(id string, chatter bool) error {
+	sf.deleted = append(sf.deleted, id)
+	return nil
+}
+
+func (sf *FailingSalesforceClient) PostComments(comments []common.Comment, chatter bool) ([]common.CommentResult, error) {
+	results := make([]common.CommentResult, len(comments))
+	for i, comment := range comments {
+		if sf.fail != nil && sf.fail(comment) {
+			results[i] = common.CommentResult{Error: "FIELD_INTEGRITY_EXCEPTION: invalid parent"}
+			continue
+		}
+		sf.posted = append(sf.posted, comment)
+		results[i] = common.CommentResult{ID: fmt.Sprintf("%s-%d", comment.CaseID, len(sf.posted)), Success: true}
+	}
+	return results, nil
+}
+
+type FailingSalesforceClientFactory struct {
+	client *FailingSalesforceClient
+}
+
+func (sf *FailingSalesforceClientFactory) NewSalesforceClient(config *config.Config) (common.SalesforceClient, error) {
+	return sf.client, nil
+}
+
+// newTestConfig returns the test configuration with the sosreports subscriber
+// changed by update.
+func newTestConfig(t *testing.T, update func(subscriber *config.Subscriber)) *config.Config {
+	cfg, err := config.NewConfigFromBytes([]byte(test.DefaultTestConfig))
+	assert.Nil(t, err)
+	cfg.Salesforce.MaxCommentLength = 3000
+	if update != nil {
+		subscriber := cfg.Processor.SubscribeTo["sosreports"]
+		update(&subscriber)
+		cfg.Processor.SubscribeTo["sosreports"] = subscriber
+	}
+	return cfg
+}
+
+// newTestProcessor returns a processor posting through the client, backed by
+// an empty in-memory database.
+func newTestProcessor(t *testing.T, cfg *config.Config, client *FailingSalesforceClient) (*Processor, *gorm.DB) {
+	dbConn, err := gorm.Open(sqlite.Open("file::memory:"))
+	assert.Nil(t, err)
+	assert.Nil(t, dbConn.AutoMigrate(db.File{}, db.Report{}, db.Script{}, db.Artifact{}, db.Case{}, db.Comment{}, db.ActionRun{}))
+	processor, err := NewProcessor(&test.FilesComClientFactory{}, &FailingSalesforceClientFactory{client: client}, &memory.MemoryProvider{}, cfg, dbConn)
+	assert.Nil(t, err)
+	return processor, dbConn
+}
+
+// createTestReport saves a hotsos report of the sosreports subscriber, old
+// enough to be part of the next batch.
+func createTestReport(t *testing.T, dbConn *gorm.DB, report db.Report) {
+	report.Created = time.Now().Add(-time.Hour)
+	report.Subscriber = "sosreports"
+	report.Name = "hotsos"
+	assert.Nil(t, dbConn.Create(&report).Error)
+}
+
+func TestBatchSalesforceCommentsPartialFailure(t *testing.T) {
+	client := &FailingSalesforceClient{fail: func(comment common.Comment) bool { return comment.CaseID == "case-fail" }}
+	processor, dbConn := newTestProcessor(t, newTestConfig(t, nil), client)
+	for _, caseId := range []string{"case-ok", "case-fail"} {
+		createTestReport(t, dbConn, db.Report{CaseID: caseId})
+	}
+	processor.BatchSalesforceComments(nil, time.Minute)
+
+	assert.NotEmpty(t, client.posted)
+	var reports []db.Report
+	assert.Nil(t, dbConn.Order("case_id").Find(&reports).Error)
+	assert.Len(t, reports, 2)
+	assert.Equal(t, "case-fail", reports[0].CaseID)
+	assert.False(t, reports[0].Commented)
+	assert.Equal(t, "case-ok", reports[1].CaseID)
+	assert.True(t, reports[1].Commented)
+}
+
+func TestBatchSalesforceCommentsResume(t *testing.T) {
+	cfg := newTestConfig(t, func(subscriber *config.Subscriber) {
+		subscriber.SFComment = "part one\npart two"
+	})
+	cfg.Salesforce.MaxCommentLength = 10
+
+	// The second chunk fails, the report stays uncommented.
+	client := &FailingSalesforceClient{fail: func(comment common.Comment) bool {
+		return strings.HasPrefix(comment.Body, "Split comment 2 of 2")
+	}}
+	processor, dbConn := newTestProcessor(t, cfg, client)
+	createTestReport(t, dbConn, db.Report{CaseID: "case"})
+	processor.BatchSalesforceComments(nil, time.Minute)
+	assert.Len(t, client.posted, 1)
+
+	var report db.Report
+	assert.Nil(t, dbConn.First(&report).Error)
+	assert.False(t, report.Commented)
+
+	// The retry only posts the missing chunk.
+	client.fail = nil
+	processor.BatchSalesforceComments(nil, time.Minute)
+	assert.Len(t, client.posted, 2)
+	assert.True(t, strings.HasPrefix(client.posted[1].Body, "Split comment 2 of 2"))
+
+	assert.Nil(t, dbConn.First(&report).Error)
+	assert.True(t, report.Commented)
+
+	var comments []db.Comment
+	assert.Nil(t, dbConn.Preload("Reports").Order("chunk").Find(&comments).Error)
+	assert.Len(t, comments, 2)
+	for i, comment := range comments {
+		assert.Equal(t, i+1, comment.Chunk)
+		assert.Equal(t, 2, comment.Chunks)
+		assert.NotEmpty(t, comment.SalesforceID)
+		assert.Len(t, comment.Reports, 1)
+	}
+}
+
+func TestBatchSalesforceCommentsResumeChanged(t *testing.T) {
+	cfg := newTestConfig(t, func(subscriber *config.Subscriber) {
+		subscriber.SFComment = "{% for report in reports %}part {{ forloop.Counter }}\n{% endfor %}"
+	})
+	cfg.Salesforce.MaxCommentLength = 10
+
+	// The second of two chunks fails.
+	client := &FailingSalesforceClient{fail: func(comment common.Comment) bool {
+		return strings.HasPrefix(comment.Body, "Split comment 2 of")
+	}}
+	processor, dbConn := newTestProcessor(t, cfg, client)
+	createTestReport(t, dbConn, db.Report{CaseID: "case"})
+	createTestReport(t, dbConn, db.Report{CaseID: "case"})
+	processor.BatchSalesforceComments(nil, time.Minute)
+	assert.Len(t, client.posted, 1)
+
+	// A report joins the batch, which now renders three chunks. Only the
+	// missing chunks are posted.
+	createTestReport(t, dbConn, db.Report{CaseID: "case"})
+	client.fail = nil
+	processor.BatchSalesforceComments(nil, time.Minute)
+	assert.Len(t, client.posted, 3)
+	assert.True(t, strings.HasPrefix(client.posted[1].Body, "Split comment 2 of 3"))
+	assert.True(t, strings.HasPrefix(client.posted[2].Body, "Split comment 3 of 3"))
+
+	var reports []db.Report
+	assert.Nil(t, dbConn.Find(&reports).Error)
+	for _, report := range reports {
+		assert.True(t, report.Commented)
+	}
+	var comments []db.Comment
+	assert.Nil(t, dbConn.Order("chunk").Find(&comments).Error)
+	assert.Len(t, comments, 3)
+	for _, comment := range comments {
+		assert.Equal(t, comments[0].BatchKey, comment.BatchKey)
+	}
+}
+
+func TestBatchSalesforceCommentsModes(t *testing.T) {
+	for _, mode := range []string{"append", "replace", "edit"} {
+		client := &FailingSalesforceClient{}
+		processor, dbConn := newTestProcessor(t, newTestConfig(t, func(subscriber *config.Subscriber) {
+			subscriber.SFCommentMode = mode
+		}), client)
+		report := db.Report{FilePath: "/uploads/sosreport-123456.tar.xz", CaseID: "case"}
+
+		// The same file is processed twice.
+		for i := 0; i < 2; i++ {
+			createTestReport(t, dbConn, report)
+			processor.BatchSalesforceComments(nil, time.Minute)
+		}
+
+		var comments []db.Comment
+		assert.Nil(t, dbConn.Preload("Reports").Find(&comments).Error)
+		switch mode {
+		case "append":
+			assert.Len(t, client.posted, 2, mode)
+			assert.Empty(t, client.deleted, mode)
+			assert.Len(t, comments, 2, mode)
+		case "replace":
+			assert.Len(t, client.posted, 2, mode)
+			assert.Equal(t, []string{"case-1"}, client.deleted, mode)
+			assert.Len(t, comments, 1, mode)
+			assert.Equal(t, "case-2", comments[0].SalesforceID, mode)
+		case "edit":
+			assert.Len(t, client.posted, 1, mode)
+			assert.Equal(t, []string{"case-1"}, client.updated, mode)
+			assert.Len(t, comments, 1, mode)
+			assert.Len(t, comments[0].Reports, 2, mode)
+		}
+
+		var uncommented int64
+		assert.Nil(t, dbConn.Model(&db.Report{}).Where("commented = ?", false).Count(&uncommented).Error)
+		assert.Zero(t, uncommented, mode)
+
+		// The previous comment stays on the case until the new one is posted.
+		if mode == "replace" {
+			client.fail = func(comment common.Comment) bool { return true }
+			createTestReport(t, dbConn, report)
+			processor.BatchSalesforceComments(nil, time.Minute)
+			assert.Equal(t, []string{"case-1"}, client.deleted, mode)
+			assert.Nil(t, dbConn.Find(&comments).Error)
+			assert.Len(t, comments, 1, mode)
+		}
+	}
+
+	_, err := NewProcessor(&test.FilesComClientFactory{}, &test.SalesforceClientFactory{}, &memory.MemoryProvider{}, &config.Config{
+		Processor: config.Processor{SubscribeTo: map[string]config.Subscriber{"sosreports": {SFCommentMode: "overwrite"}}},
+	}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestAttachOutputs(t *testing.T) {
+	cfg := &config.Config{Processor: config.Processor{SubscribeTo: map[string]config.Subscriber{
+		"sosreports": {SFAttachments: config.Attachments{Scripts: []string{"hotsos.summary", "big"}, MaxSize: "10"}},
+		"kernel":     {SFAttachments: config.Attachments{Scripts: []string{"summary"}}, SFCommentCustomers: config.CustomerFilter{Deny: []string{"ACME"}}},
+	}}}
+	runner := &ReportRunner{Config: cfg}
+	sfCase := &common.Case{Id: "5001", CaseNumber: "00123456", Customer: "ACME"}
+
+	report := &db.Report{Subscriber: "sosreports", Name: "hotsos", FileName: "sosreport.tar.xz", Scripts: []db.Script{
+		{Name: "summary", Output: "ok"},
+		{Name: "full", Output: "ok"},
+		{Name: "big", Output: "more than ten bytes"},
+	}}
+	runner.attachOutputs(&test.SalesforceClient{}, sfCase, report)
+	assert.Equal(t, "069sosreport.tar.xz.athena-hotsos.summary", report.Scripts[0].ContentDocumentID)
+	assert.Empty(t, report.Scripts[1].ContentDocumentID)
+	assert.Empty(t, report.Scripts[2].ContentDocumentID)
+
+	// Customers which do not receive comments do not get attachments either.
+	report = &db.Report{Subscriber: "kernel", Name: "kernel", Scripts: []db.Script{{Name: "summary", Output: "ok"}}}
+	runner.CustomerFilter, _ = NewCustomerFilter(cfg.Processor.SubscribeTo["kernel"].SFCommentCustomers)
+	runner.attachOutputs(&test.SalesforceClient{}, sfCase, report)
+	assert.Empty(t, report.Scripts[0].ContentDocumentID)
+
+	assert.NotNil(t, validateAttachments(config.Attachments{MaxSize: "lots"}))
+	assert.NotNil(t, validateAttachments(config.Attachments{Visibility: "Everyone"}))
+}
+
+func TestNewActions(t *testing.T) {
+	templates, err := NewTemplates(&config.Config{})
+	assert.Nil(t, err)
+	for _, action := range []config.Action{
+		{Type: "escalate"},
+		{Type: "case-field", Template: "x"},
+		{Type: "task", Template: "x"},
+		{Type: "webhook", Template: "{}"},
+		{Type: "status", Template: "{% if %}"},
+		{Type: "status", Template: "Waiting", When: []config.Condition{{Output: "("}}},
+	} {
+		_, err := NewActions([]config.Action{action}, templates)
+		assert.NotNil(t, err, action.Type)
+	}
+}
+
+func TestConditions(t *testing.T) {
+	reports := []db.Report{{Name: "hotsos", Scripts: []db.Script{
+		{Name: "summary", Output: "bugs-detected: 2\nsystem:\n  hostname: node1\n"},
+		{Name: "full", Output: "all good", ExitCode: 2},
+	}}}
+
+	for cfg, expected := range map[config.Condition]bool{
+		{}:                                     true,
+		{Output: "bugs-detected"}:              true,
+		{Script: "full", Output: "bugs"}:       false,
+		{Report: "kernel"}:                     false,
+		{Report: "hotsos", Output: "^all"}:     true,
+		{Script: "summary", Output: "^all .*"}: false,
+		{Status: "failure"}:                    true,
+		{Script: "summary", Status: "failure"}: false,
+		{Output: "good", Status: "2"}:          true,
+		{YAMLKey: "system.hostname"}:           true,
+		{YAMLKey: "system.kernel"}:             false,
+		{Script: "full", YAMLKey: "all"}:       false,
+	} {
+		conditions, err := NewConditions([]config.Condition{cfg})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, conditions.Match(reports), cfg)
+	}
+}
+
+func TestBatchSalesforceCommentsCustomerFilter(t *testing.T) {
+	client := &FailingSalesforceClient{cases: map[string]*common.Case{"123": {Id: "500", CaseNumber: "123", Customer: "ACME"}}}
+	processor, dbConn := newTestProcessor(t, newTestConfig(t, func(subscriber *config.Subscriber) {
+		subscriber.SFCommentCustomers = config.CustomerFilter{Deny: []string{"ACME"}}
+	}), client)
+	// Reports saved before the customer was recorded.
+	createTestReport(t, dbConn, db.Report{CaseID: "500", CaseNumber: "123"})
+	processor.BatchSalesforceComments(nil, time.Minute)
+
+	assert.Empty(t, client.posted)
+	var report db.Report
+	assert.Nil(t, dbConn.First(&report).Error)
+	assert.True(t, report.Skipped)
+	assert.Equal(t, "customer 'ACME' is on the deny list", report.SkipReason)
+}
+
+func TestBatchSalesforceCommentsActions(t *testing.T) {
+	var webhooks []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		webhooks = append(webhooks, string(body))
+	}))
+	defer server.Close()
+
+	client := &FailingSalesforceClient{}
+	processor, dbConn := newTestProcessor(t, newTestConfig(t, func(subscriber *config.Subscriber) {
+		subscriber.SFCommentEnabled = false
+		subscriber.Actions = []config.Action{
+			{Type: "status", Template: "Waiting on Customer", When: []config.Condition{{Script: "summary", Output: "bugs"}}},
+			{Type: "priority", Template: "High", When: []config.Condition{{Output: "kernel panic"}}},
+			{Type: "webhook", URL: server.URL, Template: `{"case": "{{ reports.0.CaseID }}"}`},
+		}
+	}), client)
+	createTestReport(t, dbConn, db.Report{
+		CaseID:  "case",
+		Scripts: []db.Script{{Name: "summary", Output: "bugs-detected: 2"}},
+	})
+	processor.BatchSalesforceComments(nil, time.Minute)
+
+	assert.Empty(t, client.posted)
+	assert.Equal(t, map[string]string{"Status": "Waiting on Customer"}, client.fields)
+	assert.Equal(t, []string{`{"case": "case"}`}, webhooks)
+
+	var runs int64
+	assert.Nil(t, dbConn.Model(&db.ActionRun{}).Count(&runs).Error)
+	assert.Equal(t, int64(2), runs)
+
+	var report db.Report
+	assert.Nil(t, dbConn.First(&report).Error)
+	assert.True(t, report.Commented)
+}
+
+func TestRunReportExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "script")
+	assert.Nil(t, os.WriteFile(script, []byte("echo partial\nexit 2\n"), 0700))
+
+	report := &ReportToExecute{BaseDir: dir, Scripts: map[string]string{"summary": script}}
+	_, err := RunReport(report)
+	assert.NotNil(t, err)
+
+	report.AcceptedExitCodes = map[string]string{"summary": "0 2"}
+	output, err := RunReport(report)
+	assert.Nil(t, err)
+	assert.Equal(t, "partial\n", string(output["summary"]))
+	assert.Equal(t, 2, report.ExitCodes["summary"])
+
+	assert.True(t, exitCodeAccepted("", 0))
+	assert.True(t, exitCodeAccepted("any", 1))
+	assert.False(t, exitCodeAccepted("0 2", 1))
+}
+
+func TestBatchSalesforceCommentsCommentWhen(t *testing.T) {
+	client := &FailingSalesforceClient{}
+	processor, dbConn := newTestProcessor(t, newTestConfig(t, func(subscriber *config.Subscriber) {
+		subscriber.CommentWhen = []config.Condition{{Script: "summary", YAMLKey: "bugs-detected"}}
+	}), client)
+	for caseId, output := range map[string]string{"case-bugs": "bugs-detected: 2", "case-clean": "{}"} {
+		createTestReport(t, dbConn, db.Report{
+			CaseID:  caseId,
+			Scripts: []db.Script{{Name: "summary", Output: output}},
+		})
+	}
+	processor.BatchSalesforceComments(nil, time.Minute)
+
+	assert.Len(t, client.posted, 1)
+	assert.Equal(t, "case-bugs", client.posted[0].CaseID)
+
+	var report db.Report
+	assert.Nil(t, dbConn.Where("case_id = ?", "case-clean").First(&report).Error)
+	assert.True(t, report.Skipped)
+	assert.Equal(t, "comment-when conditions not met", report.SkipReason)
+
+	// With actions the reports are not flagged as commented either once the
+	// actions ran.
+	client = &FailingSalesforceClient{}
+	processor, dbConn = newTestProcessor(t, newTestConfig(t, func(subscriber *config.Subscriber) {
+		subscriber.CommentWhen = []config.Condition{{Script: "summary", YAMLKey: "bugs-detected"}}
+		subscriber.Actions = []config.Action{{Type: "status", Template: "Waiting on Customer"}}
+	}), client)
+	createTestReport(t, dbConn, db.Report{
+		CaseID:  "case-clean",
+		Scripts: []db.Script{{Name: "summary", Output: "{}"}},
+	})
+	processor.BatchSalesforceComments(nil, time.Minute)
+
+	assert.Empty(t, client.posted)
+	assert.Equal(t, map[string]string{"Status": "Waiting on Customer"}, client.fields)
+	report = db.Report{}
+	assert.Nil(t, dbConn.First(&report).Error)
+	assert.False(t, report.Commented)
+	assert.True(t, report.Skipped)
+	assert.Equal(t, "comment-when conditions not met", report.SkipReason)
+}
+
+func TestParseOutput(t *testing.T) {
+	data, err := parseOutput("yaml", []byte("known-bugs:\n  - id: LP#1\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"known-bugs": []interface{}{map[string]interface{}{"id": "LP#1"}}}, data)
+
+	data, err = parseOutput("json", []byte(`{"bugs": 2}`))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"bugs": float64(2)}, data)
+
+	data, err = parseOutput("text", []byte(`{"bugs": 2}`))
+	assert.Nil(t, err)
+	assert.Nil(t, data)
+
+	_, err = parseOutput("json", []byte("bugs: 2"))
+	assert.NotNil(t, err)
+
+	assert.NotNil(t, validateOutputFormats(map[string]config.Report{
+		"hotsos": {Scripts: map[string]config.Script{"summary": {OutputFormat: "xml"}}},
+	}))
+}
+
+func TestBatchSalesforceCommentsStructuredOutput(t *testing.T) {
+	client := &FailingSalesforceClient{}
+	processor, dbConn := newTestProcessor(t, newTestConfig(t, func(subscriber *config.Subscriber) {
+		subscriber.SFComment = `{% for script in reports.0.Scripts %}{% for key, bugs in script.Data %}{% if key == "known-bugs" %}{% for bug in bugs %}{{ bug.id }} {% endfor %}{% endif %}{% endfor %}{% endfor %}`
+	}), client)
+	createTestReport(t, dbConn, db.Report{
+		CaseID: "case",
+		Scripts: []db.Script{{
+			Name:         "summary",
+			Output:       "known-bugs:\n  - id: LP#1\n  - id: LP#2\npotential-issues: []\n",
+			OutputFormat: "yaml",
+		}},
+	})
+	processor.BatchSalesforceComments(nil, time.Minute)
+
+	assert.Len(t, client.posted, 1)
+	assert.Equal(t, "LP#1 LP#2 ", client.posted[0].Body)
+}
+
+func TestTemplates(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.FilesCom.Endpoint = "https://files.example.com/"
+	cfg.Salesforce.Endpoint = "https://login.example.com"
+	cfg.Processor.Templates = map[string]string{
+		"bugs":   `{% for bug in script.Data|yaml_get:"known-bugs" %}{{ bug.id }} {% endfor %}`,
+		"header": `Case {{ case_link(case) }}`,
+	}
+	templates, err := NewTemplates(cfg)
+	assert.Nil(t, err)
+
+	ctx := pongo2.Context{
+		"case_link": caseLink("https://sf.example.com/"),
+		"case":      "500",
+		"script":    db.Script{Data: map[string]interface{}{"known-bugs": []interface{}{map[string]interface{}{"id": "LP#1"}}}},
+		"lines":     "a\nb\nc",
+		"doc":       "system:\n  nodes: [n1, n2]",
+		"markdown":  "# Bugs\n- **LP#1** in `kernel`\n\n[Docs](https://d.example.com) <x>",
+		"links":     "[Run](JavaScript:void), [Mail](mailto:support@example.com)",
+	}
+	for tpl, expected := range map[string]string{
+		`{% include "header" %}: {% include "bugs" %}`: "Case https://sf.example.com/lightning/r/Case/500/view: LP#1 ",
+		`{{ files_url("/customers/report.txt") }}`:     "https://files.example.com/files/customers/report.txt",
+		`{{ lines|truncate_lines:2 }}`:                 "a\nb\n[... 1 more lines]",
+		`{{ lines|truncate_lines:3 }}`:                 "a\nb\nc",
+		`{{ doc|yaml_get:"system.nodes.1" }}`:          "n2",
+		`{{ doc|yaml_get:"system.kernel" }}`:           "",
+		`{{ 5400|humanize_duration }}`:                 "1h 30m",
+		`{{ "49h30s"|humanize_duration }}`:             "2d 1h",
+		`{{ markdown|markdown }}`:                      `<p><b>Bugs</b></p><ul><li><b>LP#1</b> in <code>kernel</code></li></ul><p><a href="https://d.example.com">Docs</a> &lt;x&gt;</p>`,
+		`{{ links|markdown }}`:                         `<p>Run, <a href="mailto:support@example.com">Mail</a></p>`,
+	} {
+		out, err := templates.Render(ctx, tpl)
+		assert.Nil(t, err, tpl)
+		assert.Equal(t, expected, out, tpl)
+	}
+
+	assert.NotNil(t, templates.Check(`{% include "footer" %}`))
+	assert.NotNil(t, templates.Check(`{{ x|unknown_filter }}`))
+
+	cfg.Processor.Templates["broken"] = "{% if %}"
+	_, err = NewTemplates(cfg)
+	assert.NotNil(t, err)
+}
+
+func TestPrepareScripts(t *testing.T) {
+	templates, err := NewTemplates(&config.Config{})
+	assert.Nil(t, err)
+	runner := &ReportRunner{Basedir: t.TempDir(), Templates: templates}
+	report := &ReportToExecute{
+		Name:       "hotsos",
+		Subscriber: "sosreports",
+		BaseDir:    runner.Basedir,
+		File:       &db.File{Path: "/uploads/sosreport-123'$(id).tar.xz", Size: 2048, Created: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+		ScriptBodies: map[string]string{
+			"env":      `echo "$ATHENA_CASE_NUMBER $ATHENA_REPORT $ATHENA_CUSTOMER" $ATHENA_FILE_SIZE $ATHENA_UPLOADED {{ file }}`,
+			"args":     `basename "$1"`,
+			"template": `echo {{ file }} {{ customer }}`,
+		},
+		Templated: map[string]bool{"template": true},
+	}
+	assert.Nil(t, runner.prepareScripts(report, &common.Case{Id: "500", CaseNumber: "123", Customer: "ACME & Co"}))
+	assert.Contains(t, report.Environment, "ATHENA_CASE_ID=500")
+	assert.Contains(t, report.Environment, "ATHENA_FILEPATH="+filepath.Join(runner.Basedir, "sosreport-123'$(id).tar.xz"))
+
+	output, err := RunReport(report)
+	assert.Nil(t, err)
+	assert.Equal(t, "123 hotsos ACME & Co 2048 2024-05-01T12:00:00Z {{ file }}\n", string(output["env"]))
+	assert.Equal(t, "sosreport-123'$(id).tar.xz\n", string(output["args"]))
+	assert.Equal(t, "sosreport-123'$(id).tar.xz ACME & Co\n", string(output["template"]))
+
+	// Scripts written for the old rendering are rejected at startup.
+	_, err = NewProcessor(&test.FilesComClientFactory{}, &test.SalesforceClientFactory{}, &memory.MemoryProvider{}, &config.Config{
+		Processor: config.Processor{SubscribeTo: map[string]config.Subscriber{"sosreports": {Reports: map[string]config.Report{
+			"hotsos": {Scripts: map[string]config.Script{"summary": {Run: `hotsos {{ filepath }}`}}},
+		}}}},
+	}, nil)
+	assert.ErrorContains(t, err, "script 'hotsos.summary' uses template variables without 'template: true' or 'template: false'")
+
+	// Braces which do not use the variables are run as they are, as are
+	// scripts with 'template: false'.
+	literal := false
+	for _, script := range []config.Script{
+		{Run: `docker inspect -f '{{ .State.Status }}' athena`},
+		{Run: `echo '{{ unknown }}' "${#ATHENA_FILE}"`},
+		{Run: `hotsos {{ filepath }}`, Template: &literal},
+	} {
+		newTestProcessor(t, newTestConfig(t, func(subscriber *config.Subscriber) {
+			subscriber.Reports = map[string]config.Report{"hotsos": {Scripts: map[string]config.Script{"summary": script}}}
+		}), &FailingSalesforceClient{})
+	}
+}
+
+func TestBatchSalesforceCommentsCaseContext(t *testing.T) {
+	client := &FailingSalesforceClient{}
+	processor, dbConn := newTestProcessor(t, newTestConfig(t, func(subscriber *config.Subscriber) {
+		subscriber.SFComment = `{{ case_number }} {{ case_id }} {{ case.Customer }} {{ subscriber }} {{ report }} {{ reports.0.FileSize }} {{ case_link(case_id) }}`
+	}), client)
+	createTestReport(t, dbConn, db.Report{
+		CaseID:     "500",
+		CaseNumber: "123",
+		Customer:   "ACME",
+		FileSize:   2048,
+	})
+	processor.BatchSalesforceComments(nil, time.Minute)
+
+	assert.Len(t, client.posted, 1)
+	assert.Equal(t, "123 500 ACME sosreports hotsos 2048 https://test.my.salesforce.com/lightning/r/Case/500/view", client.posted[0].Body)
+}
+
+func TestSandbox(t *testing.T) {
+	_, err := NewExecutor(config.Report{Runner: "vm"})
+	assert.NotNil(t, err)
+	sandbox, err := NewExecutor(config.Report{Runner: "host"})
+	assert.Nil(t, err)
+	assert.Nil(t, sandbox)
+	_, err = NewExecutor(config.Report{Runner: "sandbox", Sandbox: config.Sandbox{Command: "athena-no-such-bwrap"}})
+	assert.NotNil(t, err)
+
+	// Stands in for bubblewrap, which only runs the command after "--".
+	dir := t.TempDir()
+	fakeBwrap := filepath.Join(dir, "bwrap")
+	assert.Nil(t, os.WriteFile(fakeBwrap, []byte("#!/bin/bash\nwhile [ \"$1\" != -- ]; do shift; done\nshift\nexec \"$@\"\n"), 0700))
+	_, err = NewExecutor(config.Report{Runner: "sandbox", Sandbox: config.Sandbox{Command: fakeBwrap, CPUTime: "x"}})
+	assert.NotNil(t, err)
+
+	sandbox, err = NewExecutor(config.Report{Runner: "sandbox", Sandbox: config.Sandbox{
+		Command: fakeBwrap, CPUTime: "1m", Memory: "4G", FileSize: "8K", Binds: []string{"/snap"},
+	}})
+	assert.Nil(t, err)
+	command := strings.Join(sandbox.Wrap("/base/script", []string{"/base/file"}, []string{"ATHENA_CASE_NUMBER=123"}, "/base", "/base/work"), " ")
+	assert.Contains(t, command, "--unshare-all --clearenv --ro-bind-try /usr /usr ")
+	assert.NotContains(t, command, "--ro-bind / /")
+	assert.NotContains(t, command, "--share-net")
+	assert.Contains(t, command, "--ro-bind-try /snap /snap ")
+	assert.Contains(t, command, "--ro-bind /base /base --bind /base/work /base/work --chdir /base/work")
+	assert.Contains(t, command, "--setenv PATH /usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin --setenv HOME /base/work --setenv ATHENA_CASE_NUMBER 123 --")
+	_, err = NewExecutor(config.Report{Runner: "sandbox", Sandbox: config.Sandbox{Command: fakeBwrap, Binds: []string{"snap"}}})
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasSuffix(command, `-- bash -c ulimit -t 60 -v 4194304 -f 8 && "$0" "$@" /base/script /base/file`), command)
+
+	// The disk space is limited by tmpfs mounts instead of the host directory.
+	_, err = NewExecutor(config.Report{Runner: "sandbox", Sandbox: config.Sandbox{Command: fakeBwrap, Disk: "lots"}})
+	assert.NotNil(t, err)
+	limited, err := NewExecutor(config.Report{Runner: "sandbox", Sandbox: config.Sandbox{Command: fakeBwrap, Disk: "1G"}})
+	assert.Nil(t, err)
+	command = strings.Join(limited.Wrap("/base/script", nil, nil, "/base", "/base/work"), " ")
+	assert.Contains(t, command, "--size 1073741824 --tmpfs /tmp --ro-bind /base /base --size 1073741824 --tmpfs /base/work --chdir /base/work")
+	assert.NotContains(t, command, "--bind /base/work")
+
+	templates, err := NewTemplates(&config.Config{})
+	assert.Nil(t, err)
+	runner := &ReportRunner{Basedir: t.TempDir(), Templates: templates}
+	report := &ReportToExecute{
+		Name:         "hotsos",
+		BaseDir:      runner.Basedir,
+		File:         &db.File{Path: "/uploads/sosreport-123.tar.xz"},
+		ScriptBodies: map[string]string{"limits": `ulimit -f; pwd; echo "$ATHENA_WORKDIR"`},
+		Executor:     sandbox,
+	}
+	assert.Nil(t, runner.prepareScripts(report, &common.Case{}))
+	assert.NotEqual(t, runner.Basedir, report.WorkDir)
+	assert.Equal(t, runner.Basedir, filepath.Dir(report.WorkDir))
+
+	output, err := RunReport(report)
+	assert.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf("8\n%s\n%s\n", report.WorkDir, report.WorkDir), string(output["limits"]))
+}
+
+func TestContainer(t *testing.T) {
+	_, err := NewExecutor(config.Report{Runner: "container", Container: config.Container{Runtime: "sh"}})
+	assert.NotNil(t, err)
+	_, err = NewExecutor(config.Report{Runner: "container", Container: config.Container{Runtime: "athena-no-such-runtime", Image: "hotsos"}})
+	assert.NotNil(t, err)
+	_, err = NewExecutor(config.Report{Runner: "container", Container: config.Container{Runtime: "sh", Image: "hotsos", CPUs: "many"}})
+	assert.NotNil(t, err)
+
+	// Stands in for the container runtime, which only runs the command after
+	// the image.
+	dir := t.TempDir()
+	fakeRuntime := filepath.Join(dir, "podman")
+	assert.Nil(t, os.WriteFile(fakeRuntime, []byte("#!/bin/bash\nwhile [ \"$1\" != athena/hotsos ]; do shift; done\nshift\nexec \"$@\"\n"), 0700))
+	container, err := NewExecutor(config.Report{Runner: "container", Container: config.Container{
+		Runtime: fakeRuntime, Image: "athena/hotsos", Memory: "1G", CPUs: "2", Options: []string{"--security-opt", "label=disable"},
+	}})
+	assert.Nil(t, err)
+	command := strings.Join(container.Wrap("/base/script", []string{"/base/file"}, []string{"ATHENA_CASE_ID=500"}, "/base", "/base/work"), " ")
+	assert.Equal(t, fakeRuntime+" run --rm --init --userns=keep-id --network none --memory 1073741824 --cpus 2 "+
+		"--volume /base:/base:ro --volume /base/work:/base/work --workdir /base/work --env ATHENA_CASE_ID "+
+		`--security-opt label=disable athena/hotsos bash -c "$0" "$@" /base/script /base/file`, command)
+
+	// Docker runs the scripts as the user of the processor.
+	docker := &Container{Container: config.Container{Runtime: "/usr/bin/docker", Image: "athena/hotsos", Network: true}}
+	command = strings.Join(docker.Wrap("/base/script", nil, nil, "/base", "/base/work"), " ")
+	assert.True(t, strings.HasPrefix(command, fmt.Sprintf("/usr/bin/docker run --rm --init --user %d:%d --volume", os.Getuid(), os.Getgid())), command)
+
+	templates, err := NewTemplates(&config.Config{})
+	assert.Nil(t, err)
+	runner := &ReportRunner{Basedir: t.TempDir(), Templates: templates}
+	report := &ReportToExecute{
+		Name:              "hotsos",
+		BaseDir:           runner.Basedir,
+		File:              &db.File{Path: "/uploads/sosreport-123.tar.xz"},
+		ScriptBodies:      map[string]string{"summary": "echo \"$ATHENA_CASE_ID\" \"$(basename \"$1\")\"\nexit 2\n"},
+		AcceptedExitCodes: map[string]string{"summary": "2"},
+		Timeout:           time.Minute,
+		Executor:          container,
+	}
+	assert.Nil(t, runner.prepareScripts(report, &common.Case{Id: "500"}))
+
+	output, err := RunReport(report)
+	assert.Nil(t, err)
+	assert.Equal(t, "500 sosreport-123.tar.xz\n", string(output["summary"]))
+	assert.Equal(t, 2, report.ExitCodes["summary"])
+}
+
+func TestRunReportStderr(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "script")
+	assert.Nil(t, os.WriteFile(script, []byte("echo bugs-detected: 0\necho 'deprecated option' >&2\n"), 0700))
+
+	report := &ReportToExecute{BaseDir: dir, Scripts: map[string]string{"summary": script}}
+	output, err := RunReport(report)
+	assert.Nil(t, err)
+	assert.Equal(t, "bugs-detected: 0\n", string(output["summary"]))
+	assert.Equal(t, "deprecated option\n", string(report.Stderr["summary"]))
+}
+
+func TestUploadAndSaveReport(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Processor.ReportsUploadPath = "/athena"
+	dbConn, err := gorm.Open(sqlite.Open("file::memory:"))
+	assert.Nil(t, err)
+	assert.Nil(t, dbConn.AutoMigrate(db.File{}, db.Report{}, db.Script{}, db.Artifact{}))
+	file := db.File{Path: "/uploads/sosreport-123.tar.xz", Size: 2048}
+	assert.Nil(t, dbConn.Create(&file).Error)
+
+	runner := &ReportRunner{Config: cfg, Db: dbConn, FilesComClientFactory: &test.FilesComClientFactory{}}
+	report := &ReportToExecute{
+		Name:         "hotsos",
+		Subscriber:   "sosreports",
+		File:         &file,
+		ExitCodes:    map[string]int{"summary": 0, "full": 0},
+		Stderr:       map[string][]byte{"summary": []byte("warning\n"), "full": []byte("warning\n")},
+		UploadStderr: map[string]bool{"summary": true},
+	}
+	sfCase := &common.Case{Id: "500", CaseNumber: "123", Customer: "ACME"}
+	assert.Nil(t, runner.UploadAndSaveReport(report, &test.SalesforceClient{}, sfCase, map[string][]byte{
+		"summary": []byte("summary\n"),
+		"full":    []byte("full\n"),
+	}))
+
+	var saved db.Report
+	assert.Nil(t, dbConn.Preload("Scripts", func(db *gorm.DB) *gorm.DB { return db.Order("name") }).First(&saved).Error)
+	assert.Equal(t, int64(2048), saved.FileSize)
+	assert.Len(t, saved.Scripts, 2)
+	assert.Equal(t, "full\n", saved.Scripts[0].Output)
+	assert.Equal(t, "warning\n", saved.Scripts[0].Stderr)
+	assert.Empty(t, saved.Scripts[0].StderrUploadLocation)
+	assert.Equal(t, "/athena/sosreport-123.tar.xz.athena-hotsos-1.summary", saved.Scripts[1].UploadLocation)
+	assert.Equal(t, "/athena/sosreport-123.tar.xz.athena-hotsos-1.summary.stderr", saved.Scripts[1].StderrUploadLocation)
+	assert.False(t, saved.Skipped)
+}
+
+func TestArtifacts(t *testing.T) {
+	assert.NotNil(t, validateArtifacts(map[string]config.Report{"hotsos": {Scripts: map[string]config.Script{"summary": {Artifacts: []string{"../secrets"}}}}}))
+	assert.NotNil(t, validateArtifacts(map[string]config.Report{"hotsos": {Scripts: map[string]config.Script{"summary": {Artifacts: []string{"/etc/*"}}}}}))
+	assert.NotNil(t, validateArtifacts(map[string]config.Report{"hotsos": {Scripts: map[string]config.Script{"summary": {Artifacts: []string{"out/["}}}}}))
+
+	workDir := t.TempDir()
+	outside := filepath.Join(t.TempDir(), "passwd")
+	assert.Nil(t, os.WriteFile(outside, []byte("root"), 0600))
+	assert.Nil(t, os.MkdirAll(filepath.Join(workDir, "hotsos-out", "plugins"), 0700))
+	for name, content := range map[string]string{
+		"hotsos-out/summary.yaml":        "bugs: 1",
+		"hotsos-out/plugins/kernel.yaml": "panic: no",
+		"report.json":                    "{}",
+		"report.txt":                     "ignored",
+	} {
+		assert.Nil(t, os.WriteFile(filepath.Join(workDir, name), []byte(content), 0600))
+	}
+	assert.Nil(t, os.Symlink(outside, filepath.Join(workDir, "hotsos-out", "passwd")))
+	assert.Nil(t, os.Symlink(filepath.Dir(outside), filepath.Join(workDir, "host")))
+
+	files, err := collectArtifacts(workDir, []string{"hotsos-out", "*.json", "host/*", "missing/*"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"hotsos-out/plugins/kernel.yaml", "hotsos-out/summary.yaml", "report.json"}, files)
+
+	report := &ReportToExecute{
+		WorkDir:          workDir,
+		Artifacts:        map[string][]string{"summary": {"hotsos-out"}, "full": {"*.json"}},
+		ArchiveArtifacts: map[string]bool{"summary": true},
+	}
+	artifacts, err := uploadArtifacts(&test.FilesComClient{}, report, "full", "/athena/sosreport.athena-hotsos.full")
+	assert.Nil(t, err)
+	assert.Equal(t, []db.Artifact{{Name: "report.json", Size: 2, UploadLocation: "/athena/sosreport.athena-hotsos.full.artifacts/report.json"}}, artifacts)
+
+	artifacts, err = uploadArtifacts(&test.FilesComClient{}, report, "summary", "/athena/sosreport.athena-hotsos.summary")
+	assert.Nil(t, err)
+	assert.Len(t, artifacts, 1)
+	assert.Equal(t, "/athena/sosreport.athena-hotsos.summary.artifacts.tar.gz", artifacts[0].UploadLocation)
+
+	content, err := archiveArtifacts(workDir, []string{"hotsos-out/summary.yaml"})
+	assert.Nil(t, err)
+	gz, err := gzip.NewReader(bytes.NewReader(content))
+	assert.Nil(t, err)
+	archive := tar.NewReader(gz)
+	header, err := archive.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, "hotsos-out/summary.yaml", header.Name)
+	data, err := io.ReadAll(archive)
+	assert.Nil(t, err)
+	assert.Equal(t, "bugs: 1", string(data))
+}
+
+func TestUploadPath(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.FilesCom.Endpoint = "https://files.example.com"
+	cfg.Processor.ReportsUploadPath = "/athena"
+	dbConn, err := gorm.Open(sqlite.Open("file::memory:"))
+	assert.Nil(t, err)
+	assert.Nil(t, dbConn.AutoMigrate(db.File{}, db.Report{}, db.Script{}, db.Artifact{}))
+	file := db.File{Path: "/uploads/sosreport-123.tar.xz", Size: 2048}
+	assert.Nil(t, dbConn.Create(&file).Error)
+
+	templates, err := NewTemplates(cfg)
+	assert.Nil(t, err)
+	runner := &ReportRunner{Config: cfg, Db: dbConn, FilesComClientFactory: &test.FilesComClientFactory{}, Templates: templates}
+	report := &ReportToExecute{
+		Name:       "hotsos",
+		Subscriber: "sosreports",
+		File:       &file,
+		UploadPath: "{{ case_number }}/{{ customer }}/{{ file }}/{{ report }}.txt",
+	}
+	sfCase := &common.Case{Id: "500", CaseNumber: "123", Customer: "ACME/Corp & Co"}
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, runner.UploadAndSaveReport(report, &test.SalesforceClient{}, sfCase, map[string][]byte{
+			"summary": []byte("summary\n"),
+			"full":    []byte("full\n"),
+		}))
+	}
+
+	var scripts []db.Script
+	assert.Nil(t, dbConn.Order("upload_location").Find(&scripts).Error)
+	var locations []string
+	for _, script := range scripts {
+		locations = append(locations, script.UploadLocation)
+	}
+	assert.Equal(t, []string{
+		"/athena/123/ACME_Corp & Co/sosreport-123.tar.xz/hotsos-1-full.txt",
+		"/athena/123/ACME_Corp & Co/sosreport-123.tar.xz/hotsos-1-summary.txt",
+		"/athena/123/ACME_Corp & Co/sosreport-123.tar.xz/hotsos-2-full.txt",
+		"/athena/123/ACME_Corp & Co/sosreport-123.tar.xz/hotsos-2-summary.txt",
+	}, locations)
+	assert.Equal(t, "https://files.example.com/files/athena/123/ACME_Corp & Co/sosreport-123.tar.xz/hotsos-2-summary.txt", scripts[3].UploadURL)
+
+	newReport := &db.Report{FileName: "sosreport-123.tar.xz", FilePath: file.Path, CaseNumber: "123"}
+	report.UploadPath = "/archive/{{ date }}/{{ case_number }}.{{ script }}"
+	uploadPath, err := runner.outputUploadPath(report, newReport, "summary")
+	assert.Nil(t, err)
+	assert.Equal(t, "/archive/0001-01-01/123.summary", uploadPath)
+	report.UploadPath = "../{{ script }}"
+	_, err = runner.outputUploadPath(report, newReport, "summary")
+	assert.NotNil(t, err)
+	report.UploadPath = "{{ report }}/"
+	_, err = runner.outputUploadPath(report, newReport, "summary")
+	assert.NotNil(t, err)
+	report.UploadPath = ""
+	uploadPath, err = runner.outputUploadPath(report, newReport, "summary")
+	assert.Nil(t, err)
+	assert.Equal(t, "/athena/sosreport-123.tar.xz.athena-hotsos.summary", uploadPath)
+}
+
+func TestBatchSalesforceCommentsOverflow(t *testing.T) {
+	for _, overflow := range []string{"split", "truncate", "attach"} {
+		cfg := newTestConfig(t, func(subscriber *config.Subscriber) {
+			subscriber.SFComment = "{{ reports.0.Scripts.0.Output }}"
+			subscriber.SFCommentOverflow = overflow
+		})
+		cfg.FilesCom.Endpoint = "https://files.example.com"
+		cfg.Salesforce.MaxCommentLength = 200
+
+		client := &FailingSalesforceClient{}
+		processor, dbConn := newTestProcessor(t, cfg, client)
+		createTestReport(t, dbConn, db.Report{
+			CaseID:   "case",
+			FileName: "sosreport-123.tar.xz",
+			Scripts: []db.Script{{
+				Name:           "summary",
+				Output:         strings.Repeat("xé", 250),
+				UploadLocation: "/athena/sosreport-123.tar.xz.athena-hotsos.summary",
+			}},
+		})
+		processor.BatchSalesforceComments(nil, time.Minute)
+
+		switch overflow {
+		case "split":
+			assert.Len(t, client.posted, 3)
+			for _, comment := range client.posted {
+				assert.Contains(t, comment.Body, "Split comment")
+				assert.LessOrEqual(t, utf8.RuneCountInString(comment.Body), 200)
+			}
+		case "truncate":
+			assert.Len(t, client.posted, 1)
+			assert.LessOrEqual(t, utf8.RuneCountInString(client.posted[0].Body), 200)
+			assert.True(t, strings.HasSuffix(client.posted[0].Body, "\nhttps://files.example.com/files/athena/sosreport-123.tar.xz.athena-hotsos.summary"))
+		case "attach":
+			assert.Len(t, client.posted, 1)
+			assert.LessOrEqual(t, utf8.RuneCountInString(client.posted[0].Body), 200)
+			assert.Equal(t, []string{"sosreport-123.tar.xz.athena-hotsos.comment"}, client.attached)
+			assert.Contains(t, client.posted[0].Body, "attached to the case as sosreport-123.tar.xz.athena-hotsos.comment")
+		}
+	}
+}
+
+func TestMaxCommentLength(t *testing.T) {
+	processor := &Processor{Config: &config.Config{}}
+	assert.Equal(t, 4000, processor.maxCommentLength())
+	processor.Config.Salesforce.MaxCommentLength = 3000
+	processor.Config.Salesforce.MaxChatterLength = 9000
+	assert.Equal(t, 3000, processor.maxCommentLength())
+	processor.Config.Salesforce.EnableChatter = true
+	assert.Equal(t, 9000, processor.maxCommentLength())
+	processor.Config.Salesforce.MaxChatterLength = 20000
+	assert.Equal(t, 10000, processor.maxCommentLength())
+	processor.Config.Salesforce.MaxChatterLength = 0
+	assert.Equal(t, 3000, processor.maxCommentLength())
+}
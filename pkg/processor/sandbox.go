@@ -0,0 +1,143 @@
+package processor
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/canonical/athena-core/pkg/common"
+	"github.com/canonical/athena-core/pkg/config"
+)
+
+const defaultSandboxCommand = "bwrap"
+
+// sandboxPath is the PATH of the scripts in the sandbox.
+const sandboxPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// sandboxSystemPaths are the host paths the scripts need to run programs,
+// mounted read-only if they exist. Everything else of the host, e.g. the
+// configuration of the processor with its credentials, is not visible.
+var sandboxSystemPaths = []string{
+	"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/libx32",
+	"/etc/alternatives", "/etc/ssl", "/etc/ca-certificates", "/etc/ld.so.cache",
+	"/etc/ld.so.conf", "/etc/ld.so.conf.d", "/etc/localtime", "/etc/passwd",
+	"/etc/group", "/etc/nsswitch.conf", "/etc/hosts", "/etc/resolv.conf",
+}
+
+// Sandbox runs scripts with bubblewrap in private namespaces. Only the system
+// directories, the configured binds and the base directory are visible,
+// read-only, besides the work directory and a private /tmp. The environment
+// is cleared except for PATH, HOME and the ATHENA_* variables, and the
+// network is not available unless enabled. Resource limits are rlimits set
+// with ulimit, the disk space is limited by size-limited tmpfs mounts.
+type Sandbox struct {
+	config.Sandbox
+	cpuTime  time.Duration
+	memory   int64
+	fileSize int64
+	disk     int64
+}
+
+func NewSandbox(cfg config.Sandbox) (*Sandbox, error) {
+	sandbox := &Sandbox{Sandbox: cfg}
+	if sandbox.Command == "" {
+		sandbox.Command = defaultSandboxCommand
+	}
+	if _, err := exec.LookPath(sandbox.Command); err != nil {
+		return nil, fmt.Errorf("sandbox command '%s' not found: %s", sandbox.Command, err)
+	}
+	var err error
+	if cfg.CPUTime != "" {
+		if sandbox.cpuTime, err = time.ParseDuration(cfg.CPUTime); err != nil {
+			return nil, fmt.Errorf("invalid sandbox cpu-time '%s': %s", cfg.CPUTime, err)
+		}
+	}
+	if sandbox.memory, err = common.ParseSize(cfg.Memory); err != nil {
+		return nil, fmt.Errorf("invalid sandbox memory: %s", err)
+	}
+	if sandbox.fileSize, err = common.ParseSize(cfg.FileSize); err != nil {
+		return nil, fmt.Errorf("invalid sandbox file-size: %s", err)
+	}
+	if sandbox.disk, err = common.ParseSize(cfg.Disk); err != nil {
+		return nil, fmt.Errorf("invalid sandbox disk: %s", err)
+	}
+	for _, bind := range cfg.Binds {
+		if !filepath.IsAbs(bind) {
+			return nil, fmt.Errorf("sandbox bind '%s' is not an absolute path", bind)
+		}
+	}
+	return sandbox, nil
+}
+
+// ulimits returns the bash command setting the resource limits.
+func (s *Sandbox) ulimits() string {
+	var limits []string
+	if s.cpuTime > 0 {
+		limits = append(limits, fmt.Sprintf("-t %d", int64(s.cpuTime.Seconds())))
+	}
+	if s.memory > 0 {
+		limits = append(limits, fmt.Sprintf("-v %d", s.memory/1024))
+	}
+	if s.fileSize > 0 {
+		limits = append(limits, fmt.Sprintf("-f %d", s.fileSize/1024))
+	}
+	if len(limits) == 0 {
+		return ""
+	}
+	return "ulimit " + strings.Join(limits, " ") + " && "
+}
+
+// tmpfs returns the options mounting a tmpfs at the path, limited to the
+// configured disk size.
+func (s *Sandbox) tmpfs(path string) []string {
+	if s.disk > 0 {
+		return []string{"--size", strconv.FormatInt(s.disk, 10), "--tmpfs", path}
+	}
+	return []string{"--tmpfs", path}
+}
+
+// Wrap returns the command line running the script in the sandbox. The
+// base directory holding the file and the scripts is mounted read-only, the
+// work directory, which has to be inside it, is writable. With a disk limit
+// the work directory is a tmpfs of that size instead of the host directory.
+func (s *Sandbox) Wrap(script string, args, environment []string, baseDir, workDir string) []string {
+	command := []string{
+		s.Command,
+		"--die-with-parent",
+		"--new-session",
+		"--unshare-all",
+		"--clearenv",
+	}
+	if s.Network {
+		command = append(command, "--share-net")
+	}
+	for _, path := range slices.Concat(sandboxSystemPaths, s.Binds) {
+		command = append(command, "--ro-bind-try", path, path)
+	}
+	command = append(command, "--dev", "/dev", "--proc", "/proc")
+	command = append(command, s.tmpfs("/tmp")...)
+	command = append(command, "--ro-bind", baseDir, baseDir)
+	if s.disk > 0 {
+		command = append(command, s.tmpfs(workDir)...)
+	} else {
+		command = append(command, "--bind", workDir, workDir)
+	}
+	command = append(command,
+		"--chdir", workDir,
+		"--setenv", "PATH", sandboxPath,
+		"--setenv", "HOME", workDir,
+	)
+	for _, variable := range environment {
+		name, value, _ := strings.Cut(variable, "=")
+		command = append(command, "--setenv", name, value)
+	}
+	command = append(command,
+		"--",
+		"bash", "-c", s.ulimits()+scriptCommand, script,
+	)
+	return append(command, args...)
+}
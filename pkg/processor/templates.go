@@ -0,0 +1,278 @@
+package processor
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/canonical/athena-core/pkg/config"
+	"github.com/flosch/pongo2/v4"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	registerFiltersOnce sync.Once
+	registerFiltersErr  error
+)
+
+// registerFilters registers the filters of the templates. pongo2 only has
+// global filters, so they are registered once for all template sets.
+func registerFilters() error {
+	registerFiltersOnce.Do(func() {
+		for name, filter := range map[string]pongo2.FilterFunction{
+			"truncate_lines":    filterTruncateLines,
+			"yaml_get":          filterYAMLGet,
+			"humanize_duration": filterHumanizeDuration,
+			"markdown":          filterMarkdown,
+		} {
+			if err := pongo2.RegisterFilter(name, filter); err != nil {
+				registerFiltersErr = fmt.Errorf("failed to register filter '%s': %s", name, err)
+				return
+			}
+		}
+	})
+	return registerFiltersErr
+}
+
+// templateLoader resolves {% include %} tags to the named templates of the
+// configuration.
+type templateLoader map[string]string
+
+func (l templateLoader) Abs(_, name string) string {
+	return name
+}
+
+func (l templateLoader) Get(name string) (io.Reader, error) {
+	tpl, ok := l[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown template '%s'", name)
+	}
+	return strings.NewReader(tpl), nil
+}
+
+// Templates renders the comment, action and script templates with the named
+// templates and the functions depending on the configuration.
+type Templates struct {
+	set       *pongo2.TemplateSet
+	functions pongo2.Context
+}
+
+// NewTemplates checks the named templates of the configuration.
+func NewTemplates(cfg *config.Config) (*Templates, error) {
+	if err := registerFilters(); err != nil {
+		return nil, err
+	}
+	templates := &Templates{
+		set: pongo2.NewSet("athena", templateLoader(cfg.Processor.Templates)),
+		functions: pongo2.Context{
+			"files_url": func(path string) string {
+				return filesURL(cfg, path)
+			},
+		},
+	}
+	for name, tpl := range cfg.Processor.Templates {
+		if err := templates.Check(tpl); err != nil {
+			return nil, fmt.Errorf("template '%s': %s", name, err)
+		}
+	}
+	return templates, nil
+}
+
+// filesURL returns the files.com web URL of the path.
+func filesURL(cfg *config.Config, path string) string {
+	return strings.TrimRight(cfg.FilesCom.Endpoint, "/") + "/files/" + strings.TrimLeft(path, "/")
+}
+
+// caseLink returns the case_link function of the comment and action
+// templates. Cases are served by the instance of the session, not by the
+// login endpoint.
+func caseLink(instanceURL string) func(caseId string) string {
+	return func(caseId string) string {
+		return strings.TrimRight(instanceURL, "/") + "/lightning/r/Case/" + caseId + "/view"
+	}
+}
+
+// Check returns an error if the template cannot be parsed.
+func (t *Templates) Check(data string) error {
+	_, err := t.set.FromString(data)
+	return err
+}
+
+// Render renders the template with the variables of the context.
+func (t *Templates) Render(ctx pongo2.Context, data string) (string, error) {
+	tpl, err := t.set.FromString(data)
+	if err != nil {
+		return "", err
+	}
+	variables := pongo2.Context{}
+	variables.Update(t.functions)
+	return tpl.Execute(variables.Update(ctx))
+}
+
+// filterTruncateLines keeps the first lines of the input, e.g.
+// {{ script.Output|truncate_lines:10 }}.
+func filterTruncateLines(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	lines := strings.Split(strings.TrimRight(in.String(), "\n"), "\n")
+	if param.Integer() < 0 || len(lines) <= param.Integer() {
+		return in, nil
+	}
+	omitted := len(lines) - param.Integer()
+	lines = append(lines[:param.Integer()], fmt.Sprintf("[... %d more lines]", omitted))
+	return pongo2.AsValue(strings.Join(lines, "\n")), nil
+}
+
+// filterYAMLGet returns the value of a dotted key of parsed data or of a YAML
+// document, e.g. {{ script.Data|yaml_get:"known-bugs" }}.
+func filterYAMLGet(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	data := in.Interface()
+	if in.IsString() {
+		if err := yaml.Unmarshal([]byte(in.String()), &data); err != nil {
+			return pongo2.AsValue(nil), nil
+		}
+	}
+	value, _ := lookupKey(data, param.String())
+	return pongo2.AsValue(value), nil
+}
+
+// filterHumanizeDuration formats a duration, a duration string or a number of
+// seconds, e.g. 1h 30m.
+func filterHumanizeDuration(in *pongo2.Value, _ *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	var duration time.Duration
+	switch value := in.Interface().(type) {
+	case time.Duration:
+		duration = value
+	case string:
+		var err error
+		if duration, err = time.ParseDuration(value); err != nil {
+			return in, nil
+		}
+	default:
+		if !in.IsNumber() {
+			return in, nil
+		}
+		duration = time.Duration(in.Float() * float64(time.Second))
+	}
+	return pongo2.AsValue(humanizeDuration(duration)), nil
+}
+
+// humanizeDuration returns the two largest units of the duration.
+func humanizeDuration(duration time.Duration) string {
+	if duration < 0 {
+		duration = -duration
+	}
+	units := []struct {
+		suffix string
+		length time.Duration
+	}{{"d", 24 * time.Hour}, {"h", time.Hour}, {"m", time.Minute}, {"s", time.Second}}
+	var parts []string
+	for _, unit := range units {
+		if count := duration / unit.length; count > 0 && len(parts) < 2 {
+			parts = append(parts, fmt.Sprintf("%d%s", count, unit.suffix))
+			duration -= count * unit.length
+		} else if len(parts) > 0 {
+			break
+		}
+	}
+	if len(parts) == 0 {
+		return "0s"
+	}
+	return strings.Join(parts, " ")
+}
+
+// filterMarkdown converts markdown to the HTML subset supported by Salesforce
+// rich text fields, e.g. chatter posts.
+func filterMarkdown(in *pongo2.Value, _ *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	return pongo2.AsSafeValue(markdownToRichText(in.String())), nil
+}
+
+var (
+	markdownHeading  = regexp.MustCompile(`^#{1,6}\s+(.*)$`)
+	markdownBullet   = regexp.MustCompile(`^[-*+]\s+(.*)$`)
+	markdownNumbered = regexp.MustCompile(`^\d+[.)]\s+(.*)$`)
+	markdownCode     = regexp.MustCompile("`([^`]+)`")
+	markdownBold     = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	markdownItalic   = regexp.MustCompile(`(^|[^\w*])[*_]([^*_]+)[*_]`)
+	markdownLink     = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+)
+
+// markdownLinkSchemes are the schemes of the links kept by markdownInline.
+var markdownLinkSchemes = []string{"http", "https", "mailto"}
+
+// markdownInlineLink converts a link of escaped markdown. Links with other
+// schemes, e.g. javascript:, only keep their text.
+func markdownInlineLink(link string) string {
+	match := markdownLink.FindStringSubmatch(link)
+	target, err := url.Parse(html.UnescapeString(match[2]))
+	if err != nil || !slices.Contains(markdownLinkSchemes, strings.ToLower(target.Scheme)) {
+		return match[1]
+	}
+	return `<a href="` + match[2] + `">` + match[1] + `</a>`
+}
+
+// markdownInline converts the inline markup of a line.
+func markdownInline(line string) string {
+	line = html.EscapeString(line)
+	line = markdownLink.ReplaceAllStringFunc(line, markdownInlineLink)
+	line = markdownCode.ReplaceAllString(line, "<code>$1</code>")
+	line = markdownBold.ReplaceAllString(line, "<b>$1</b>")
+	return markdownItalic.ReplaceAllString(line, "$1<i>$2</i>")
+}
+
+func markdownToRichText(text string) string {
+	var out strings.Builder
+	var paragraph []string
+	list := "" // ul or ol while in a list
+
+	flush := func() {
+		if len(paragraph) > 0 {
+			out.WriteString("<p>" + strings.Join(paragraph, "<br>") + "</p>")
+			paragraph = nil
+		}
+	}
+	openList := func(kind string) {
+		flush()
+		if list != kind {
+			if list != "" {
+				out.WriteString("</" + list + ">")
+			}
+			out.WriteString("<" + kind + ">")
+			list = kind
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			out.WriteString("</" + list + ">")
+			list = ""
+		}
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if match := markdownHeading.FindStringSubmatch(line); match != nil {
+			flush()
+			closeList()
+			out.WriteString("<p><b>" + markdownInline(match[1]) + "</b></p>")
+		} else if match := markdownBullet.FindStringSubmatch(line); match != nil {
+			openList("ul")
+			out.WriteString("<li>" + markdownInline(match[1]) + "</li>")
+		} else if match := markdownNumbered.FindStringSubmatch(line); match != nil {
+			openList("ol")
+			out.WriteString("<li>" + markdownInline(match[1]) + "</li>")
+		} else if line == "" {
+			flush()
+			closeList()
+		} else {
+			closeList()
+			paragraph = append(paragraph, markdownInline(line))
+		}
+	}
+	flush()
+	closeList()
+	return out.String()
+}
@@ -0,0 +1,101 @@
+package processor
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/canonical/athena-core/pkg/common/db"
+	"github.com/flosch/pongo2/v4"
+)
+
+// pathComponent makes a value safe to use as a part of an upload path, so that
+// e.g. a customer name cannot add directories.
+func pathComponent(value string) string {
+	value = strings.ReplaceAll(value, "/", "_")
+	if value == "." || value == ".." {
+		return "_"
+	}
+	return value
+}
+
+// uploadPathContext returns the variables of the upload-path template for the
+// output of the script, documented in the README.
+func uploadPathContext(report *ReportToExecute, newReport *db.Report, scriptName string) pongo2.Context {
+	ctx := pongo2.Context{}
+	for name, value := range map[string]string{
+		"case_number": newReport.CaseNumber,
+		"case_id":     newReport.CaseID,
+		"customer":    newReport.Customer,
+		"date":        newReport.Created.UTC().Format("2006-01-02"),
+		"file":        newReport.FileName,
+		"subscriber":  report.Subscriber,
+		"report":      report.Name,
+		"script":      scriptName,
+	} {
+		ctx[name] = pongo2.AsSafeValue(pathComponent(value))
+	}
+	return ctx
+}
+
+// outputUploadPath returns where the output of the script is uploaded. Without
+// an upload-path template the output is uploaded next to the file, or into
+// the reports-upload-dir. Relative paths rendered from the template are
+// resolved the same way.
+func (runner *ReportRunner) outputUploadPath(report *ReportToExecute, newReport *db.Report, scriptName string) (string, error) {
+	uploadDir := runner.Config.Processor.ReportsUploadPath
+	if uploadDir == "" {
+		uploadDir = path.Dir(newReport.FilePath)
+	}
+	if report.UploadPath == "" {
+		return fmt.Sprintf(DefaultReportOutputFormat, path.Join(uploadDir, newReport.FileName), report.Name, scriptName), nil
+	}
+
+	rendered, err := runner.Templates.Render(uploadPathContext(report, newReport, scriptName), report.UploadPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to render upload-path: %s", err)
+	}
+	rendered = strings.TrimSpace(rendered)
+	if rendered == "" || strings.HasSuffix(rendered, "/") {
+		return "", fmt.Errorf("upload-path '%s' is not a file", rendered)
+	}
+	if path.IsAbs(rendered) {
+		return path.Clean(rendered), nil
+	}
+	if strings.HasPrefix(path.Clean(rendered), "..") {
+		return "", fmt.Errorf("upload-path '%s' is outside of the upload directory", rendered)
+	}
+	return path.Join(uploadDir, rendered), nil
+}
+
+// pathWithSuffix adds the suffix to the name of the path, before its
+// extension.
+func pathWithSuffix(uploadPath, suffix string) string {
+	ext := path.Ext(uploadPath)
+	return strings.TrimSuffix(uploadPath, ext) + "-" + suffix + ext
+}
+
+// outputUploadPaths returns where the outputs of the scripts are uploaded.
+// The ID of the report is added to the paths, so that outputs of other
+// reports, e.g. of files with the same name, never overwrite them. Outputs of
+// the report which share a path also get the name of their script.
+func (runner *ReportRunner) outputUploadPaths(report *ReportToExecute, newReport *db.Report, scriptOutputs map[string][]byte) (map[string]string, error) {
+	uploadPaths := make(map[string]string)
+	shared := make(map[string]int)
+	for scriptName := range scriptOutputs {
+		uploadPath, err := runner.outputUploadPath(report, newReport, scriptName)
+		if err != nil {
+			return nil, err
+		}
+		uploadPaths[scriptName] = uploadPath
+		shared[uploadPath]++
+	}
+	for scriptName, uploadPath := range uploadPaths {
+		unique := pathWithSuffix(uploadPath, fmt.Sprint(newReport.ID))
+		if shared[uploadPath] > 1 {
+			unique = pathWithSuffix(unique, pathComponent(scriptName))
+		}
+		uploadPaths[scriptName] = unique
+	}
+	return uploadPaths, nil
+}